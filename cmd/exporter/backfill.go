@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/config"
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/updater"
+)
+
+// runBackfill implements the backfill subcommand, which writes historical stats
+// as OpenMetrics for `promtool tsdb create-blocks-from openmetrics`.
+// It returns the process exit code.
+func runBackfill(args []string) int {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	configFile := fs.String("config", "", "path to an optional YAML or JSON configuration file")
+	from := fs.String("from", "", "start of the range, as YYYY-MM-DD in the instance timezone or RFC 3339 (required)")
+	to := fs.String("to", "", "end of the range, same format as --from (default: start of today)")
+	step := fs.String("step", "1d", "length of each step, also used as the window label")
+	output := fs.String("output", "-", "file to write, - for stdout")
+	fs.Parse(args)
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	if *from == "" {
+		logger.Println("backfill: --from is required")
+		return 2
+	}
+	w, err := config.ParseWindow(*step)
+	if err != nil {
+		logger.Printf("backfill: --step: %v", err)
+		return 2
+	}
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		logger.Printf("config: %v", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rec := prommetrics.NewRecorder(cfg.ExtraLabels())
+	failed := false
+	for i := range cfg.Instances {
+		in := &cfg.Instances[i]
+		instLogger := instanceLogger(logger, cfg, in)
+
+		start, err := parseDate(*from, in.Location)
+		if err != nil {
+			logger.Printf("backfill: --from: %v", err)
+			return 2
+		}
+		now := time.Now().In(in.Location)
+		end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, in.Location)
+		if *to != "" {
+			if end, err = parseDate(*to, in.Location); err != nil {
+				logger.Printf("backfill: --to: %v", err)
+				return 2
+			}
+			if end.After(now) {
+				end = now
+			}
+		}
+
+		upd := updater.New(newClient(in, nil), nil, in, instLogger)
+		err = upd.Backfill(ctx, start, end, w, func(s *prommetrics.Snapshot, ts time.Time) error {
+			return rec.Record(in.Name, s, ts)
+		})
+		if err != nil {
+			instLogger.Printf("backfill: %v", err)
+			failed = true
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			logger.Printf("backfill: %v", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	bw := bufio.NewWriter(out)
+	if err := rec.Write(bw); err != nil {
+		logger.Printf("backfill: write: %v", err)
+		return 1
+	}
+	if err := bw.Flush(); err != nil {
+		logger.Printf("backfill: write: %v", err)
+		return 1
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// parseDate parses a date (midnight in loc) or an RFC 3339 timestamp.
+func parseDate(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: use YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata" // calendar windows may use any timezone, even without system tzdata
 
 	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/config"
 	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
@@ -17,33 +19,60 @@ import (
 )
 
 func main() {
-	cfg, err := config.LoadFromEnv()
-	if err != nil {
-		log.Fatalf("config: %v", err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			os.Exit(runBackfill(os.Args[2:]))
+		case "once":
+			os.Exit(runOnceCommand(os.Args[2:]))
+		}
 	}
 
-	logger := log.New(os.Stdout, "", log.LstdFlags)
+	configFile := flag.String("config", "", "path to an optional YAML or JSON configuration file")
+	once := flag.Bool("once", false, "run a single update cycle, print the metrics to stdout and exit")
+	format := flag.String("format", "text", "output format of --once: text or json")
+	webConfigFile := flag.String("web.config.file", "", "path to a web configuration file enabling TLS and basic authentication (overrides EXPORTER_WEB_CONFIG_FILE)")
+	flag.Parse()
 
-	httpClient := &http.Client{Timeout: cfg.HTTPTimeout}
+	if *once {
+		os.Exit(runOnce(*configFile, *format))
+	}
 
-	client := umami.New(cfg.UmamiURL, cfg.Username, cfg.Password, httpClient)
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
 
-	metrics := prommetrics.New()
+	if *webConfigFile != "" {
+		cfg.WebConfigFile = *webConfigFile
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
 
-	upd := updater.New(client, metrics, cfg.Interval, cfg.Concurrency, cfg.MetricLimit, cfg.MetricTypes, logger)
+	metrics := prommetrics.New(cfg.ExtraLabels())
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	// Start updater loop
-	go upd.Start(ctx)
+	// One client and updater per Umami instance
+	updaters := make([]*updater.Updater, 0, len(cfg.Instances))
+	for i := range cfg.Instances {
+		in := &cfg.Instances[i]
+		upd := updater.New(newClient(in, metrics), metrics, in, instanceLogger(logger, cfg, in))
+		updaters = append(updaters, upd)
 
-	srv := server.NewHTTPServer(":"+cfg.Port, upd, logger)
+		// Start updater loop, unless websites are only collected through /probe
+		if !in.ProbeOnly {
+			go upd.Start(ctx)
+		}
+	}
+
+	srv := server.NewHTTPServer(":"+cfg.Port, metrics, updaters, logger)
 
 	// Start HTTP server
 	go func() {
 		logger.Printf("server: starting on %s", srv.Addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.ListenAndServe(srv, cfg.WebConfigFile, logger); err != nil && err != http.ErrServerClosed {
 			logger.Fatalf("server: listen error: %v", err)
 		}
 	}()
@@ -63,3 +92,35 @@ func main() {
 	time.Sleep(100 * time.Millisecond)
 	logger.Println("main: exiting")
 }
+
+// instanceLogger returns the logger of an instance, prefixed with its name when
+// several instances are configured.
+func instanceLogger(logger *log.Logger, cfg *config.Config, in *config.Instance) *log.Logger {
+	if len(cfg.Instances) < 2 {
+		return logger
+	}
+	return log.New(logger.Writer(), "instance="+in.Name+" ", logger.Flags()|log.Lmsgprefix)
+}
+
+// newClient creates the Umami client of an instance, recording its requests in
+// m unless m is nil.
+func newClient(in *config.Instance, m *prommetrics.Metrics) *umami.Client {
+	httpClient := &http.Client{Timeout: in.HTTPTimeout}
+	var client *umami.Client
+	if in.APIKey != "" {
+		client = umami.NewWithAPIKey(in.UmamiURL, in.APIKey, httpClient)
+	} else {
+		client = umami.New(in.UmamiURL, in.Username, in.Password, httpClient)
+	}
+	client.SetRetryPolicy(umami.RetryPolicy{
+		MaxRetries: in.Retries,
+		MinBackoff: in.RetryMinBackoff,
+		MaxBackoff: in.RetryMaxBackoff,
+	})
+	client.SetRateLimit(in.RateLimit, in.RateBurst)
+	if m != nil {
+		client.SetObserver(m.APIObserver(in.Name))
+	}
+	client.SetCircuitBreaker(in.BreakerThreshold, in.BreakerCooldown)
+	return client
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/config"
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/updater"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runOnceCommand implements the once subcommand.
+func runOnceCommand(args []string) int {
+	fs := flag.NewFlagSet("once", flag.ExitOnError)
+	configFile := fs.String("config", "", "path to an optional YAML or JSON configuration file")
+	format := fs.String("format", "text", "output format: text or json")
+	fs.Parse(args)
+	return runOnce(*configFile, *format)
+}
+
+// runOnce runs a single update cycle for every instance and writes the
+// resulting metrics to stdout. Logs go to stderr. It returns the process exit
+// code, 1 if the cycle of any instance failed.
+func runOnce(configFile, format string) int {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	if format != "text" && format != "json" {
+		logger.Printf("once: invalid format %q: must be text or json", format)
+		return 2
+	}
+
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		logger.Printf("config: %v", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reg := prometheus.NewRegistry()
+	metrics := prommetrics.NewWithRegisterer(reg, cfg.ExtraLabels())
+	code := 0
+	for i := range cfg.Instances {
+		in := &cfg.Instances[i]
+		upd := updater.New(newClient(in, metrics), metrics, in, instanceLogger(logger, cfg, in))
+		if !upd.RunOnce(ctx) {
+			code = 1
+		}
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		logger.Printf("once: gather: %v", err)
+		return 1
+	}
+	if format == "json" {
+		err = writeJSON(os.Stdout, mfs)
+	} else {
+		err = writeText(os.Stdout, mfs)
+	}
+	if err != nil {
+		logger.Printf("once: write: %v", err)
+		return 1
+	}
+	return code
+}
+
+// writeText writes metric families in the Prometheus text exposition format.
+func writeText(w io.Writer, mfs []*dto.MetricFamily) error {
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonFamily is the JSON form of a metric family written by --format json.
+type jsonFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Samples []jsonSample `json:"samples"`
+}
+
+// jsonSample holds the value of a gauge or counter, or the count, sum and
+// cumulative bucket counts (keyed by upper bound) of a histogram.
+type jsonSample struct {
+	Labels  map[string]string `json:"labels"`
+	Value   *float64          `json:"value,omitempty"`
+	Count   *uint64           `json:"count,omitempty"`
+	Sum     *float64          `json:"sum,omitempty"`
+	Buckets map[string]uint64 `json:"buckets,omitempty"`
+}
+
+// writeJSON writes metric families as a JSON array.
+func writeJSON(w io.Writer, mfs []*dto.MetricFamily) error {
+	out := make([]jsonFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		f := jsonFamily{Name: mf.GetName(), Help: mf.GetHelp(), Type: strings.ToLower(mf.GetType().String())}
+		for _, m := range mf.GetMetric() {
+			s := jsonSample{Labels: make(map[string]string, len(m.GetLabel()))}
+			for _, lp := range m.GetLabel() {
+				s.Labels[lp.GetName()] = lp.GetValue()
+			}
+			switch {
+			case m.Gauge != nil:
+				s.Value = m.Gauge.Value
+			case m.Counter != nil:
+				s.Value = m.Counter.Value
+			case m.Untyped != nil:
+				s.Value = m.Untyped.Value
+			case m.Histogram != nil:
+				h := m.GetHistogram()
+				s.Count, s.Sum = h.SampleCount, h.SampleSum
+				s.Buckets = make(map[string]uint64, len(h.GetBucket())+1)
+				for _, b := range h.GetBucket() {
+					s.Buckets[strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)] = b.GetCumulativeCount()
+				}
+				s.Buckets["+Inf"] = h.GetSampleCount()
+			default:
+				return fmt.Errorf("metric %s: unsupported type %s", mf.GetName(), mf.GetType())
+			}
+			f.Samples = append(f.Samples, s)
+		}
+		out = append(out, f)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -4,41 +4,567 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/normalize"
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/umami"
+	"github.com/prometheus/common/model"
+	"go.yaml.in/yaml/v2"
 )
 
-// Config holds exporter configuration read from environment variables.
+// Config holds exporter configuration read from environment variables and,
+// optionally, from a YAML or JSON configuration file.
+//
+// The embedded Instance holds the top-level Umami settings. They describe the
+// only instance when Instances is empty in the file and act as defaults for
+// every entry of Instances otherwise. After Load, Instances always lists the
+// fully resolved instances to scrape.
 type Config struct {
-	UmamiURL    string
-	Username    string
-	Password    string
-	Port        string
-	Interval    time.Duration
-	Concurrency int
-	MetricLimit int
+	Port string `yaml:"port"`
+	// WebConfigFile is the path of an exporter-toolkit web configuration file
+	// enabling TLS and authentication on the HTTP server.
+	WebConfigFile string `yaml:"web_config_file"`
+
+	Instance  `yaml:",inline"`
+	Instances []Instance `yaml:"instances"`
+}
+
+// Instance holds the settings of one Umami deployment scraped by the exporter.
+type Instance struct {
+	Name         string        `yaml:"name"`
+	UmamiURL     string        `yaml:"umami_url"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+	APIKey       string        `yaml:"api_key"`
+	Interval     time.Duration `yaml:"refresh_interval"`
+	Concurrency  int           `yaml:"concurrency"`
+	MetricLimit  int           `yaml:"metric_limit"`
+	MetricTopN   int           `yaml:"metric_top_n"`
+	SeriesBudget int           `yaml:"series_budget"`
+	MetricTypes  []string      `yaml:"metric_types"`
+	HTTPTimeout  time.Duration `yaml:"http_timeout"`
+	StaleWindow  time.Duration `yaml:"stale_window"`
+	Windows      []string      `yaml:"windows"`
+	Timezone     string        `yaml:"timezone"`
+	BucketUnits  []string      `yaml:"bucket_units"`
+	ProbeTTL     time.Duration `yaml:"probe_ttl"`
+	ProbeOnly    bool          `yaml:"probe_only"`
+
+	// Retries of failed GET requests, see umami.RetryPolicy.
+	Retries         int           `yaml:"retries"`
+	RetryMinBackoff time.Duration `yaml:"retry_min_backoff"`
+	RetryMaxBackoff time.Duration `yaml:"retry_max_backoff"`
+	// RateLimit caps requests per second to Umami (0 for no limit), allowing
+	// bursts of RateBurst requests.
+	RateLimit float64 `yaml:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst"`
+	// RequestBudget caps the requests of an update cycle (0 for no limit).
+	RequestBudget int `yaml:"request_budget"`
+	// BreakerThreshold consecutive failed requests stop requests to Umami for
+	// BreakerCooldown (0 disables the circuit breaker).
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+	// LivenessTimeout is how long the update loop may go without starting or
+	// finishing a cycle, beyond one refresh interval, before /livez fails.
+	LivenessTimeout time.Duration `yaml:"liveness_timeout"`
+	// ReadyIntervals is the number of refresh intervals after which the data
+	// of the last successful cycle is too old for /readyz.
+	ReadyIntervals int `yaml:"ready_intervals"`
+	// CacheDir holds the file the website cache is saved to after every cycle
+	// and restored from at startup, named after the instance. Empty disables it.
+	CacheDir string `yaml:"cache_dir"`
+	// RefreshIntervals overrides Interval per kind of data, keyed by the Refresh
+	// constants or a metric type.
+	RefreshIntervals map[string]time.Duration `yaml:"refresh_intervals"`
+
+	// URLRules normalizes entries of the url metric type.
+	URLRules normalize.URLRules `yaml:"url_rules"`
+	// ReferrerRules groups entries of the referrer metric type by domain.
+	ReferrerRules normalize.ReferrerRules `yaml:"referrer_grouping"`
+	// EventProperties lists the custom event properties whose values are exported.
+	EventProperties []EventProperty `yaml:"event_properties"`
+
+	// Location is the loaded Timezone, used to compute calendar windows.
+	Location *time.Location `yaml:"-"`
+	// URLNormalizer is the compiled URLRules, nil when no rule is enabled.
+	URLNormalizer *normalize.URLNormalizer `yaml:"-"`
+	// ReferrerGrouper is the compiled ReferrerRules, nil when grouping is disabled.
+	ReferrerGrouper *normalize.ReferrerGrouper `yaml:"-"`
+	windows         []Window
+
+	// Websites holds per-website overrides. Only available from a config file.
+	Websites []WebsiteConfig `yaml:"websites"`
+}
+
+// WebsiteConfig overrides the global settings for one website, matched by ID or domain.
+// Zero values keep the global setting.
+type WebsiteConfig struct {
+	ID          string            `yaml:"id"`
+	Domain      string            `yaml:"domain"`
+	Disabled    bool              `yaml:"disabled"`
+	MetricTypes []string          `yaml:"metric_types"`
+	MetricLimit int               `yaml:"metric_limit"`
+	MetricTopN  int               `yaml:"metric_top_n"`
+	Windows     []string          `yaml:"windows"`
+	Labels      map[string]string `yaml:"labels"`
+
+	RefreshIntervals map[string]time.Duration `yaml:"refresh_intervals"`
+
+	windows []Window
+}
+
+// EventProperty selects a property of a custom event. "*" as Event or Property
+// selects every event or property recorded.
+type EventProperty struct {
+	Event    string `yaml:"event"`
+	Property string `yaml:"property"`
+}
+
+// WebsiteSettings are the effective settings for one website once overrides are applied.
+type WebsiteSettings struct {
+	Disabled    bool
 	MetricTypes []string
-	HTTPTimeout time.Duration
+	MetricLimit int
+	MetricTopN  int
+	Windows     []Window
+	Labels      map[string]string
+
+	Interval         time.Duration
+	RefreshIntervals map[string]time.Duration
+}
+
+// Kinds of data refreshed on their own interval besides metric types, which
+// are keyed by their name in RefreshIntervals.
+const (
+	RefreshActive          = "active"
+	RefreshBuckets         = "buckets"
+	RefreshStats           = "stats"
+	RefreshEventProperties = "event_properties"
+)
+
+// RefreshInterval returns how often data of kind (one of the Refresh constants
+// or a metric type) is fetched.
+func (s WebsiteSettings) RefreshInterval(kind string) time.Duration {
+	if d, ok := s.RefreshIntervals[kind]; ok {
+		return d
+	}
+	return s.Interval
+}
+
+// reservedLabels cannot be used as extra website labels.
+var reservedLabels = map[string]struct{}{
+	"instance": {}, "website_id": {}, "name": {}, "domain": {}, "window": {}, "type": {}, "value": {},
+	"event": {}, "property": {}, "unit": {},
 }
 
 // LoadFromEnv reads configuration from environment variables and returns a Config.
-// Required environment variables:
-//   - UMAMI_URL
-//   - UMAMI_USERNAME
-//   - UMAMI_PASSWORD
+// Authentication uses either username/password or an API key, never both:
+//   - UMAMI_URL (required with username/password, defaults to Umami Cloud with an API key)
+//   - UMAMI_USERNAME and UMAMI_PASSWORD (self-hosted instances)
+//   - UMAMI_API_KEY (Umami Cloud)
 //
 // Optional environment variables and defaults:
 //   - EXPORTER_PORT (default "9465")
+//   - EXPORTER_WEB_CONFIG_FILE (default none, see server.ListenAndServe)
+//   - UMAMI_INSTANCE_NAME (default "default", value of the instance label)
 //   - UMAMI_REFRESH_INTERVAL (default "1m")
 //   - UMAMI_CONCURRENCY (default 5)
 //   - UMAMI_METRIC_LIMIT (default 100)
+//   - UMAMI_METRIC_TOP_N (default 0, no limit; values beyond the top N are summed into "__other__")
+//   - UMAMI_SERIES_BUDGET (default 0, no limit on umami_metric_value series)
 //   - UMAMI_METRIC_TYPES (comma-separated, default "url,referrer,browser,os,device,country,event")
 //   - UMAMI_HTTP_TIMEOUT (default "15s")
+//   - UMAMI_STALE_WINDOW (default "10m")
+//   - UMAMI_WINDOWS (comma-separated, default "30d", see ParseWindow)
+//   - UMAMI_TIMEZONE (default "UTC", used for calendar windows)
+//   - UMAMI_BUCKET_UNITS (comma-separated minute/hour/day, default none, see LastBucket)
+//   - UMAMI_PROBE_TTL (default "1m", how long /probe results are cached)
+//   - UMAMI_PROBE_ONLY (default false, only collect websites through /probe)
+//   - UMAMI_RETRIES (default 2, retries of failed GET requests)
+//   - UMAMI_RETRY_MIN_BACKOFF, UMAMI_RETRY_MAX_BACKOFF (default "500ms" and "10s")
+//   - UMAMI_RATE_LIMIT (default 0, no limit; requests per second)
+//   - UMAMI_RATE_BURST (default UMAMI_CONCURRENCY)
+//   - UMAMI_REQUEST_BUDGET (default 0, no limit; requests per update cycle)
+//   - UMAMI_BREAKER_THRESHOLD (default 10, 0 disables the circuit breaker)
+//   - UMAMI_BREAKER_COOLDOWN (default "30s")
+//   - UMAMI_LIVENESS_TIMEOUT (default "10m", see Updater.Alive)
+//   - UMAMI_READY_INTERVALS (default 3, see Updater.Ready)
+//   - UMAMI_CACHE_DIR (default none, directory of the cache file restored at startup)
+//   - UMAMI_REFRESH_INTERVALS (comma-separated kind=duration pairs, e.g.
+//     "active=15s,country=1h"; kinds are active, buckets, stats,
+//     event_properties or a metric type, default UMAMI_REFRESH_INTERVAL)
+//   - UMAMI_URL_STRIP_QUERY, UMAMI_URL_TRAILING_SLASH, UMAMI_URL_COLLAPSE_IDS
+//     (default false, see normalize.URLRules)
+//   - UMAMI_EVENT_PROPERTIES (comma-separated event:property pairs, either may be "*")
+//   - UMAMI_REFERRER_MODE (default "raw", or "domain" / "both", see normalize.ReferrerRules)
 func LoadFromEnv() (*Config, error) {
-	u := strings.TrimSpace(os.Getenv("UMAMI_URL"))
+	return Load("")
+}
+
+// Load reads configuration from environment variables and, when path is not empty,
+// overlays the YAML or JSON file at path. Settings present in the file take
+// precedence; environment variables act as defaults. Instances listed in the
+// file inherit every setting they leave unset from the top level.
+func Load(path string) (*Config, error) {
+	cfg := fromEnv()
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config file: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		if err := cfg.resolveInstances(b); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// fromEnv builds a Config from environment variables without validating it.
+func fromEnv() *Config {
+	cfg := &Config{
+		Port: "9465",
+		Instance: Instance{
+			Name:        "default",
+			UmamiURL:    strings.TrimSpace(os.Getenv("UMAMI_URL")),
+			Username:    os.Getenv("UMAMI_USERNAME"),
+			Password:    os.Getenv("UMAMI_PASSWORD"),
+			APIKey:      strings.TrimSpace(os.Getenv("UMAMI_API_KEY")),
+			Interval:    time.Minute,
+			Concurrency: 5,
+			MetricLimit: 100,
+			MetricTypes: []string{"url", "referrer", "browser", "os", "device", "country", "event"},
+			HTTPTimeout: 15 * time.Second,
+			StaleWindow: 10 * time.Minute,
+			Windows:     []string{"30d"},
+			Timezone:    "UTC",
+			ProbeTTL:    time.Minute,
+
+			Retries:         2,
+			RetryMinBackoff: 500 * time.Millisecond,
+			RetryMaxBackoff: 10 * time.Second,
+
+			BreakerThreshold: 10,
+			BreakerCooldown:  30 * time.Second,
+			LivenessTimeout:  10 * time.Minute,
+			ReadyIntervals:   3,
+		},
+	}
+
+	if s := strings.TrimSpace(os.Getenv("UMAMI_INSTANCE_NAME")); s != "" {
+		cfg.Name = s
+	}
+
+	if s := os.Getenv("EXPORTER_PORT"); s != "" {
+		cfg.Port = s
+	}
+	if s := strings.TrimSpace(os.Getenv("EXPORTER_WEB_CONFIG_FILE")); s != "" {
+		cfg.WebConfigFile = s
+	}
+
+	if s := os.Getenv("UMAMI_REFRESH_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			cfg.Interval = d
+		}
+	}
+
+	if s := os.Getenv("UMAMI_CONCURRENCY"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v > 0 {
+			cfg.Concurrency = v
+		}
+	}
+
+	if s := os.Getenv("UMAMI_METRIC_LIMIT"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v > 0 {
+			cfg.MetricLimit = v
+		}
+	}
+
+	if s := os.Getenv("UMAMI_METRIC_TOP_N"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v >= 0 {
+			cfg.MetricTopN = v
+		}
+	}
+
+	if s := os.Getenv("UMAMI_SERIES_BUDGET"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v >= 0 {
+			cfg.SeriesBudget = v
+		}
+	}
+
+	if s := os.Getenv("UMAMI_METRIC_TYPES"); s != "" {
+		if out := splitList(s); len(out) > 0 {
+			cfg.MetricTypes = out
+		}
+	}
+
+	if s := os.Getenv("UMAMI_HTTP_TIMEOUT"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			cfg.HTTPTimeout = d
+		}
+	}
+
+	if s := os.Getenv("UMAMI_STALE_WINDOW"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			cfg.StaleWindow = d
+		}
+	}
+
+	if s := os.Getenv("UMAMI_WINDOWS"); s != "" {
+		if out := splitList(s); len(out) > 0 {
+			cfg.Windows = out
+		}
+	}
+
+	if s := strings.TrimSpace(os.Getenv("UMAMI_TIMEZONE")); s != "" {
+		cfg.Timezone = s
+	}
+
+	if s := os.Getenv("UMAMI_BUCKET_UNITS"); s != "" {
+		cfg.BucketUnits = splitList(s)
+	}
+
+	if s := os.Getenv("UMAMI_PROBE_TTL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			cfg.ProbeTTL = d
+		}
+	}
+	if v, err := strconv.ParseBool(os.Getenv("UMAMI_PROBE_ONLY")); err == nil {
+		cfg.ProbeOnly = v
+	}
+
+	if s := os.Getenv("UMAMI_RETRIES"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v >= 0 {
+			cfg.Retries = v
+		}
+	}
+	if s := os.Getenv("UMAMI_RETRY_MIN_BACKOFF"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			cfg.RetryMinBackoff = d
+		}
+	}
+	if s := os.Getenv("UMAMI_RETRY_MAX_BACKOFF"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			cfg.RetryMaxBackoff = d
+		}
+	}
+	if s := os.Getenv("UMAMI_RATE_LIMIT"); s != "" {
+		if v, err := strconv.ParseFloat(s, 64); err == nil && v >= 0 {
+			cfg.RateLimit = v
+		}
+	}
+	if s := os.Getenv("UMAMI_RATE_BURST"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v > 0 {
+			cfg.RateBurst = v
+		}
+	}
+	if s := os.Getenv("UMAMI_REQUEST_BUDGET"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v >= 0 {
+			cfg.RequestBudget = v
+		}
+	}
+
+	if s := os.Getenv("UMAMI_BREAKER_THRESHOLD"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v >= 0 {
+			cfg.BreakerThreshold = v
+		}
+	}
+	if s := os.Getenv("UMAMI_BREAKER_COOLDOWN"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			cfg.BreakerCooldown = d
+		}
+	}
+
+	if s := os.Getenv("UMAMI_LIVENESS_TIMEOUT"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			cfg.LivenessTimeout = d
+		}
+	}
+	if s := os.Getenv("UMAMI_READY_INTERVALS"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v > 0 {
+			cfg.ReadyIntervals = v
+		}
+	}
+
+	if s := strings.TrimSpace(os.Getenv("UMAMI_CACHE_DIR")); s != "" {
+		cfg.CacheDir = s
+	}
+
+	if s := os.Getenv("UMAMI_REFRESH_INTERVALS"); s != "" {
+		for _, p := range splitList(s) {
+			kind, v, _ := strings.Cut(p, "=")
+			if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil && d > 0 {
+				if cfg.RefreshIntervals == nil {
+					cfg.RefreshIntervals = make(map[string]time.Duration)
+				}
+				cfg.RefreshIntervals[strings.TrimSpace(kind)] = d
+			}
+		}
+	}
+
+	if v, err := strconv.ParseBool(os.Getenv("UMAMI_URL_STRIP_QUERY")); err == nil {
+		cfg.URLRules.StripQuery = v
+	}
+	if v, err := strconv.ParseBool(os.Getenv("UMAMI_URL_TRAILING_SLASH")); err == nil {
+		cfg.URLRules.TrailingSlash = v
+	}
+	if v, err := strconv.ParseBool(os.Getenv("UMAMI_URL_COLLAPSE_IDS")); err == nil {
+		cfg.URLRules.CollapseIDs = v
+	}
+
+	if s := strings.TrimSpace(os.Getenv("UMAMI_REFERRER_MODE")); s != "" {
+		cfg.ReferrerRules.Mode = s
+	}
+
+	if s := os.Getenv("UMAMI_EVENT_PROPERTIES"); s != "" {
+		for _, p := range splitList(s) {
+			event, property, _ := strings.Cut(p, ":")
+			cfg.EventProperties = append(cfg.EventProperties, EventProperty{
+				Event:    strings.TrimSpace(event),
+				Property: strings.TrimSpace(property),
+			})
+		}
+	}
+
+	return cfg
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	parts := strings.Split(s, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if t := strings.TrimSpace(p); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// dedupe returns list without repeated entries, keeping the first occurrence.
+// Repeated metric types or bucket units would export the same series twice.
+func dedupe(list []string) []string {
+	if list == nil {
+		return nil
+	}
+	seen := make(map[string]struct{}, len(list))
+	out := make([]string, 0, len(list))
+	for _, s := range list {
+		if _, dup := seen[s]; !dup {
+			seen[s] = struct{}{}
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// validate resolves the list of instances and checks each of them.
+func (c *Config) validate() error {
+	if c.Port == "" {
+		c.Port = "9465"
+	}
+
+	if len(c.Instances) == 0 {
+		c.Instances = []Instance{c.Instance}
+	}
+
+	names := make(map[string]struct{}, len(c.Instances))
+	for i := range c.Instances {
+		in := &c.Instances[i]
+		if in.Name == "" {
+			return fmt.Errorf("instances[%d]: name is required", i)
+		}
+		if _, dup := names[in.Name]; dup {
+			return fmt.Errorf("instances[%d]: duplicate name %q", i, in.Name)
+		}
+		names[in.Name] = struct{}{}
+		if err := in.validate(); err != nil {
+			if len(c.Instances) > 1 {
+				return fmt.Errorf("instance %s: %w", in.Name, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveInstances makes every entry of Instances inherit from the top level
+// the settings it does not set in the config file b.
+func (c *Config) resolveInstances(b []byte) error {
+	if len(c.Instances) == 0 {
+		return nil
+	}
+	var raw struct {
+		Instances []yaml.MapSlice `yaml:"instances"`
+	}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	for i := range c.Instances {
+		var keys yaml.MapSlice
+		if i < len(raw.Instances) {
+			keys = raw.Instances[i]
+		}
+		c.Instances[i].inherit(&c.Instance, keys)
+	}
+	return nil
+}
+
+// inherit fills the settings of an instance missing from keys, its entry in the
+// config file, from the top-level defaults d. Settings present in the file are
+// kept even when zero, e.g. retries: 0 or probe_only: false. The name is never
+// inherited. Credentials are inherited as a whole so that an instance never
+// mixes its own API key with inherited username/password or vice versa.
+func (in *Instance) inherit(d *Instance, keys yaml.MapSlice) {
+	set := make(map[string]bool, len(keys))
+	for _, item := range keys {
+		if k, ok := item.Key.(string); ok {
+			set[k] = true
+		}
+	}
+
+	own := *in
+	*in = *d
+	in.Name = own.Name
+	if set["username"] || set["password"] || set["api_key"] {
+		in.Username, in.Password, in.APIKey = own.Username, own.Password, own.APIKey
+	}
+
+	dst, src := reflect.ValueOf(in).Elem(), reflect.ValueOf(&own).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		key, _, _ := strings.Cut(dst.Type().Field(i).Tag.Get("yaml"), ",")
+		if key != "" && key != "-" && set[key] {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// validate checks required settings and normalizes the Umami URL.
+func (in *Instance) validate() error {
+	if in.APIKey != "" {
+		if in.Username != "" || in.Password != "" {
+			return fmt.Errorf("UMAMI_API_KEY cannot be combined with UMAMI_USERNAME/UMAMI_PASSWORD")
+		}
+	} else if in.Username == "" || in.Password == "" {
+		return fmt.Errorf("UMAMI_USERNAME and UMAMI_PASSWORD (or UMAMI_API_KEY) are required")
+	}
+
+	u := in.UmamiURL
 	if u == "" {
-		return nil, fmt.Errorf("UMAMI_URL is required")
+		if in.APIKey == "" {
+			return fmt.Errorf("UMAMI_URL is required")
+		}
+		u = umami.CloudURL
 	}
 
 	// Validate and normalize URL. If scheme is missing try https:// prefix.
@@ -48,75 +574,226 @@ func LoadFromEnv() (*Config, error) {
 			if _, err2 := url.ParseRequestURI(u2); err2 == nil {
 				u = u2
 			} else {
-				return nil, fmt.Errorf("UMAMI_URL invalid: %v", err)
+				return fmt.Errorf("UMAMI_URL invalid: %v", err)
 			}
 		} else {
-			return nil, fmt.Errorf("UMAMI_URL invalid: %v", err)
+			return fmt.Errorf("UMAMI_URL invalid: %v", err)
 		}
 	}
+	in.UmamiURL = u
 
-	username := os.Getenv("UMAMI_USERNAME")
-	password := os.Getenv("UMAMI_PASSWORD")
-	if username == "" || password == "" {
-		return nil, fmt.Errorf("UMAMI_USERNAME and UMAMI_PASSWORD are required")
+	if in.Concurrency <= 0 {
+		return fmt.Errorf("concurrency must be positive")
+	}
+	if in.MetricTopN < 0 || in.SeriesBudget < 0 {
+		return fmt.Errorf("metric_top_n and series_budget cannot be negative")
+	}
+	if in.Retries < 0 || in.RateLimit < 0 || in.RateBurst < 0 || in.RequestBudget < 0 {
+		return fmt.Errorf("retries, rate_limit, rate_burst and request_budget cannot be negative")
+	}
+	if in.BreakerThreshold < 0 || in.BreakerCooldown < 0 {
+		return fmt.Errorf("breaker_threshold and breaker_cooldown cannot be negative")
+	}
+	if in.LivenessTimeout <= 0 || in.ReadyIntervals <= 0 {
+		return fmt.Errorf("liveness_timeout and ready_intervals must be positive")
+	}
+	if in.Retries > 0 && in.RetryMaxBackoff <= 0 {
+		return fmt.Errorf("retry_max_backoff must be positive")
+	}
+	if in.RetryMinBackoff > in.RetryMaxBackoff {
+		return fmt.Errorf("retry_min_backoff cannot exceed retry_max_backoff")
+	}
+	if in.RateBurst == 0 {
+		in.RateBurst = in.Concurrency
+	}
+	if err := validateRefreshIntervals(in.RefreshIntervals); err != nil {
+		return err
+	}
+	if len(in.Windows) == 0 {
+		return fmt.Errorf("at least one window is required")
+	}
+	windows, err := parseWindows(in.Windows)
+	if err != nil {
+		return err
+	}
+	in.windows = windows
+	loc, err := time.LoadLocation(in.Timezone)
+	if err != nil {
+		return fmt.Errorf("timezone: %w", err)
+	}
+	in.Location = loc
+	in.MetricTypes = dedupe(in.MetricTypes)
+	in.BucketUnits = dedupe(in.BucketUnits)
+	for _, unit := range in.BucketUnits {
+		if _, ok := bucketUnits[unit]; !ok {
+			return fmt.Errorf("invalid bucket unit %q: must be minute, hour or day", unit)
+		}
 	}
 
-	port := os.Getenv("EXPORTER_PORT")
-	if port == "" {
-		port = "9465"
+	if in.URLRules.Enabled() {
+		if in.URLNormalizer, err = in.URLRules.Compile(); err != nil {
+			return err
+		}
+	}
+	grouper, err := in.ReferrerRules.Compile()
+	if err != nil {
+		return err
+	}
+	if in.ReferrerRules.Enabled() {
+		in.ReferrerGrouper = grouper
 	}
 
-	interval := time.Minute
-	if s := os.Getenv("UMAMI_REFRESH_INTERVAL"); s != "" {
-		if d, err := time.ParseDuration(s); err == nil {
-			interval = d
+	for i, ep := range in.EventProperties {
+		if ep.Event == "" || ep.Property == "" {
+			return fmt.Errorf("event_properties[%d]: event and property are required", i)
 		}
 	}
 
-	concurrency := 5
-	if s := os.Getenv("UMAMI_CONCURRENCY"); s != "" {
-		if v, err := strconv.Atoi(s); err == nil && v > 0 {
-			concurrency = v
+	for i := range in.Websites {
+		w := &in.Websites[i]
+		if w.ID == "" && w.Domain == "" {
+			return fmt.Errorf("websites[%d]: id or domain is required", i)
+		}
+		if w.MetricLimit < 0 || w.MetricTopN < 0 {
+			return fmt.Errorf("websites[%d]: metric_limit and metric_top_n cannot be negative", i)
+		}
+		w.MetricTypes = dedupe(w.MetricTypes)
+		if w.Windows != nil {
+			if w.windows, err = parseWindows(w.Windows); err != nil {
+				return fmt.Errorf("websites[%d]: %w", i, err)
+			}
+		}
+		if err := validateRefreshIntervals(w.RefreshIntervals); err != nil {
+			return fmt.Errorf("websites[%d]: %w", i, err)
+		}
+		for k := range w.Labels {
+			if _, ok := reservedLabels[k]; ok {
+				return fmt.Errorf("websites[%d]: label %q is reserved", i, k)
+			}
+			if !model.LabelName(k).IsValidLegacy() {
+				return fmt.Errorf("websites[%d]: invalid label name %q", i, k)
+			}
 		}
 	}
+	return nil
+}
 
-	metricLimit := 100
-	if s := os.Getenv("UMAMI_METRIC_LIMIT"); s != "" {
-		if v, err := strconv.Atoi(s); err == nil && v > 0 {
-			metricLimit = v
+// validateRefreshIntervals checks that every refresh interval names a kind and
+// is positive.
+func validateRefreshIntervals(intervals map[string]time.Duration) error {
+	for kind, d := range intervals {
+		if kind == "" {
+			return fmt.Errorf("refresh_intervals: empty kind")
+		}
+		if d <= 0 {
+			return fmt.Errorf("refresh_intervals: %s must be positive", kind)
 		}
 	}
+	return nil
+}
 
-	metricTypes := []string{"url", "referrer", "browser", "os", "device", "country", "event"}
-	if s := os.Getenv("UMAMI_METRIC_TYPES"); s != "" {
-		parts := strings.Split(s, ",")
-		out := make([]string, 0, len(parts))
-		for _, p := range parts {
-			if t := strings.TrimSpace(p); t != "" {
-				out = append(out, t)
-			}
+// CacheFile returns the path of the cache file of the instance, or "" when
+// CacheDir is not set.
+func (in *Instance) CacheFile() string {
+	if in.CacheDir == "" {
+		return ""
+	}
+	return filepath.Join(in.CacheDir, url.PathEscape(in.Name)+".json")
+}
+
+// Scheduled reports whether some kind of data is refreshed on its own
+// interval, for the whole instance or for a website.
+func (in *Instance) Scheduled() bool {
+	if len(in.RefreshIntervals) > 0 {
+		return true
+	}
+	for _, w := range in.Websites {
+		if len(w.RefreshIntervals) > 0 {
+			return true
 		}
-		if len(out) > 0 {
-			metricTypes = out
+	}
+	return false
+}
+
+// MinRefreshInterval returns the shortest of Interval and the refresh
+// intervals of the instance and its websites, i.e. how often the updater must
+// wake up to honor every interval.
+func (in *Instance) MinRefreshInterval() time.Duration {
+	shortest := in.Interval
+	lower := func(intervals map[string]time.Duration) {
+		for _, d := range intervals {
+			if shortest <= 0 || d < shortest {
+				shortest = d
+			}
 		}
 	}
+	lower(in.RefreshIntervals)
+	for _, w := range in.Websites {
+		lower(w.RefreshIntervals)
+	}
+	return shortest
+}
 
-	timeout := 15 * time.Second
-	if s := os.Getenv("UMAMI_HTTP_TIMEOUT"); s != "" {
-		if d, err := time.ParseDuration(s); err == nil {
-			timeout = d
+// ExtraLabels returns the sorted union of extra label names used by website
+// overrides across all instances.
+func (c *Config) ExtraLabels() []string {
+	seen := map[string]struct{}{}
+	var out []string
+	for _, in := range c.Instances {
+		for _, w := range in.Websites {
+			for k := range w.Labels {
+				if _, ok := seen[k]; !ok {
+					seen[k] = struct{}{}
+					out = append(out, k)
+				}
+			}
 		}
 	}
+	sort.Strings(out)
+	return out
+}
+
+// ForWebsite returns the effective settings for a website, applying the first
+// override whose ID or domain matches.
+func (in *Instance) ForWebsite(id, domain string) WebsiteSettings {
+	ws := WebsiteSettings{
+		MetricTypes: in.MetricTypes,
+		MetricLimit: in.MetricLimit,
+		MetricTopN:  in.MetricTopN,
+		Windows:     in.windows,
 
-	return &Config{
-		UmamiURL:    u,
-		Username:    username,
-		Password:    password,
-		Port:        port,
-		Interval:    interval,
-		Concurrency: concurrency,
-		MetricLimit: metricLimit,
-		MetricTypes: metricTypes,
-		HTTPTimeout: timeout,
-	}, nil
+		Interval:         in.Interval,
+		RefreshIntervals: in.RefreshIntervals,
+	}
+	for _, w := range in.Websites {
+		if (w.ID == "" || w.ID != id) && (w.Domain == "" || !strings.EqualFold(w.Domain, domain)) {
+			continue
+		}
+		ws.Disabled = w.Disabled
+		if w.MetricTypes != nil {
+			ws.MetricTypes = w.MetricTypes
+		}
+		if w.MetricLimit > 0 {
+			ws.MetricLimit = w.MetricLimit
+		}
+		if w.MetricTopN > 0 {
+			ws.MetricTopN = w.MetricTopN
+		}
+		if len(w.windows) > 0 {
+			ws.Windows = w.windows
+		}
+		if len(w.RefreshIntervals) > 0 {
+			merged := make(map[string]time.Duration, len(in.RefreshIntervals)+len(w.RefreshIntervals))
+			for k, d := range in.RefreshIntervals {
+				merged[k] = d
+			}
+			for k, d := range w.RefreshIntervals {
+				merged[k] = d
+			}
+			ws.RefreshIntervals = merged
+		}
+		ws.Labels = w.Labels
+		break
+	}
+	return ws
 }
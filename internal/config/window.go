@@ -0,0 +1,130 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a named date range for which stats and metrics are fetched.
+// Rolling windows (e.g. "1h", "7d") end now; calendar windows ("today",
+// "yesterday", "week", "month", "last_month") are aligned on day, ISO week or
+// month boundaries in the instance timezone.
+type Window struct {
+	Name     string
+	Duration time.Duration
+	Calendar string
+}
+
+// calendarWindows lists the supported calendar window names.
+var calendarWindows = map[string]struct{}{
+	"today": {}, "yesterday": {}, "week": {}, "month": {}, "last_month": {},
+}
+
+// ParseWindow parses a window name. Rolling windows accept Go durations plus the
+// "d" (day) and "w" (week) units, e.g. "90m", "24h", "7d" or "2w".
+func ParseWindow(s string) (Window, error) {
+	s = strings.TrimSpace(s)
+	if _, ok := calendarWindows[s]; ok {
+		return Window{Name: s, Calendar: s}, nil
+	}
+
+	if s == "" {
+		return Window{}, fmt.Errorf("empty window")
+	}
+
+	var d time.Duration
+	switch n, unit := s[:len(s)-1], s[len(s)-1]; unit {
+	case 'd', 'w':
+		v, err := strconv.Atoi(n)
+		if err != nil {
+			return Window{}, fmt.Errorf("invalid window %q", s)
+		}
+		d = time.Duration(v) * 24 * time.Hour
+		if unit == 'w' {
+			d *= 7
+		}
+	default:
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return Window{}, fmt.Errorf("invalid window %q", s)
+		}
+	}
+	if d <= 0 {
+		return Window{}, fmt.Errorf("invalid window %q: must be positive", s)
+	}
+	return Window{Name: s, Duration: d}, nil
+}
+
+// parseWindows parses a list of window names, rejecting duplicates.
+func parseWindows(names []string) ([]Window, error) {
+	out := make([]Window, 0, len(names))
+	seen := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		w, err := ParseWindow(n)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := seen[w.Name]; dup {
+			return nil, fmt.Errorf("duplicate window %q", w.Name)
+		}
+		seen[w.Name] = struct{}{}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+// Range returns the start and end of the window relative to now, computing
+// calendar boundaries in loc.
+func (w Window) Range(now time.Time, loc *time.Location) (time.Time, time.Time) {
+	if w.Calendar == "" {
+		return now.Add(-w.Duration), now
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	t := now.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	switch w.Calendar {
+	case "yesterday":
+		return midnight.AddDate(0, 0, -1), midnight
+	case "week":
+		// ISO weeks start on Monday
+		offset := (int(t.Weekday()) + 6) % 7
+		return midnight.AddDate(0, 0, -offset), now
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc), now
+	case "last_month":
+		first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		return first.AddDate(0, -1, 0), first
+	default: // today
+		return midnight, now
+	}
+}
+
+// bucketUnits lists the supported time-series bucket units.
+var bucketUnits = map[string]struct{}{
+	"minute": {}, "hour": {}, "day": {},
+}
+
+// LastBucket returns the start and end of the most recent complete bucket of
+// unit (minute, hour or day) before now, with day boundaries computed in loc.
+func LastBucket(unit string, now time.Time, loc *time.Location) (time.Time, time.Time) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	t := now.In(loc)
+	var end time.Time
+	switch unit {
+	case "minute":
+		end = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+		return end.Add(-time.Minute), end
+	case "hour":
+		end = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+		return end.Add(-time.Hour), end
+	default: // day
+		end = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return end.AddDate(0, 0, -1), end
+	}
+}
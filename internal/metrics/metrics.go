@@ -1,73 +1,295 @@
 package metrics
 
 import (
+	"sort"
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Metrics holds Prometheus collectors used by the exporter.
+// Per-website series are served from one immutable Snapshot per Umami instance,
+// swapped in atomically by Publish, so a scrape never observes a partially
+// updated cycle. Every series carries an instance label.
 type Metrics struct {
-	FetchSuccess            prometheus.Gauge
-	LastFetch               prometheus.Gauge
-	WebsitePageviews        *prometheus.GaugeVec
-	WebsiteVisitors         *prometheus.GaugeVec
-	WebsiteVisits           *prometheus.GaugeVec
-	WebsiteBounces          *prometheus.GaugeVec
-	WebsiteTotaltimeSeconds *prometheus.GaugeVec
-	WebsiteActiveVisitors   *prometheus.GaugeVec
-	MetricValues            *prometheus.GaugeVec
+	FetchSuccess *prometheus.GaugeVec
+	LastFetch    *prometheus.GaugeVec
+
+	// Self-instrumentation, see self.go.
+	APIRequestDuration *prometheus.HistogramVec
+	APIRequests        *prometheus.CounterVec
+	APILogins          *prometheus.CounterVec
+	UpdateDuration     *prometheus.HistogramVec
+	WebsiteErrors      *prometheus.CounterVec
+	CircuitState       *prometheus.GaugeVec
+
+	stats                 []statMetric
+	bounceRate            *prometheus.Desc
+	avgVisitDuration      *prometheus.Desc
+	pagesPerVisit         *prometheus.Desc
+	websiteActiveVisitors *prometheus.Desc
+	bucketPageviews       *prometheus.Desc
+	bucketSessions        *prometheus.Desc
+	bucketStart           *prometheus.Desc
+	metricValue           *prometheus.Desc
+	eventPropertyValue    *prometheus.Desc
+	websiteDataStale      *prometheus.Desc
+	websiteLastSuccess    *prometheus.Desc
+	metricValuesFolded    *prometheus.Desc
+	metricValueSeries     *prometheus.Desc
+
+	// extraLabels are user-defined website labels appended after the domain label.
+	extraLabels []string
+
+	mu        sync.RWMutex
+	snapshots map[string]*Snapshot
 }
 
 // New creates and registers Prometheus metrics.
-func New() *Metrics {
+// extraLabels lists additional label names attached to every website series;
+// websites without a value for one of them get an empty label.
+func New(extraLabels []string) *Metrics {
+	return NewWithRegisterer(prometheus.DefaultRegisterer, extraLabels)
+}
+
+// NewWithRegisterer is like New but registers the metrics with reg.
+func NewWithRegisterer(reg prometheus.Registerer, extraLabels []string) *Metrics {
+	m := newMetrics(extraLabels)
+	reg.MustRegister(
+		m.FetchSuccess,
+		m.LastFetch,
+		m.APIRequestDuration,
+		m.APIRequests,
+		m.APILogins,
+		m.UpdateDuration,
+		m.WebsiteErrors,
+		m.CircuitState,
+		m,
+	)
+	return m
+}
+
+// newMetrics creates the metrics without registering them.
+func newMetrics(extraLabels []string) *Metrics {
+	websiteLabels := append([]string{"instance", "website_id", "name", "domain"}, extraLabels...)
+	websiteLabels = websiteLabels[:len(websiteLabels):len(websiteLabels)]
+	windowLabels := append(websiteLabels, "window")
+	windowLabels = windowLabels[:len(windowLabels):len(windowLabels)]
+	bucketLabels := append(websiteLabels, "unit")
 	m := &Metrics{
-		FetchSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+		extraLabels: extraLabels,
+		snapshots:   make(map[string]*Snapshot),
+		FetchSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "umami_fetch_success",
 			Help: "1 if last refresh to Umami API was successful, 0 otherwise",
-		}),
-		LastFetch: prometheus.NewGauge(prometheus.GaugeOpts{
+		}, []string{"instance"}),
+		LastFetch: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "umami_last_fetch_timestamp_seconds",
 			Help: "Unix timestamp of last successful fetch",
-		}),
-		WebsitePageviews: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "umami_website_pageviews",
-			Help: "Pageviews for website (current value)",
-		}, []string{"website_id", "name", "domain"}),
-		WebsiteVisitors: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "umami_website_visitors",
-			Help: "Visitors for website (current value)",
-		}, []string{"website_id", "name", "domain"}),
-		WebsiteVisits: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "umami_website_visits",
-			Help: "Visits for website (current value)",
-		}, []string{"website_id", "name", "domain"}),
-		WebsiteBounces: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "umami_website_bounces",
-			Help: "Bounces for website (current value)",
-		}, []string{"website_id", "name", "domain"}),
-		WebsiteTotaltimeSeconds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "umami_website_totaltime_seconds",
-			Help: "Total time spent on website (seconds)",
-		}, []string{"website_id", "name", "domain"}),
-		WebsiteActiveVisitors: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "umami_website_active_visitors",
-			Help: "Number of active visitors in last 5 minutes",
-		}, []string{"website_id", "name", "domain"}),
-		MetricValues: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "umami_metric_value",
-			Help: "Metric value for a website for a given type and value (e.g. url /path => count)",
-		}, []string{"website_id", "name", "domain", "type", "value"}),
+		}, []string{"instance"}),
+		APIRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "umami_api_request_duration_seconds",
+			Help:    "Duration of requests to the Umami API",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"instance", "endpoint", "method", "status_class"}),
+		APIRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "umami_api_requests_total",
+			Help: "Number of requests to the Umami API",
+		}, []string{"instance", "endpoint", "method", "status_class"}),
+		APILogins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "umami_api_logins_total",
+			Help: "Number of logins to the Umami API, by reason (initial or relogin after a 401) and result",
+		}, []string{"instance", "reason", "result"}),
+		UpdateDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "umami_update_duration_seconds",
+			Help:    "Duration of update cycles",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"instance"}),
+		WebsiteErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "umami_website_fetch_errors_total",
+			Help: "Number of failed requests while fetching a website during update cycles",
+		}, []string{"instance", "website_id"}),
+		CircuitState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "umami_api_circuit_breaker_state",
+			Help: "1 for the current state of the circuit breaker of the Umami client (closed, open or half_open), 0 for the others",
+		}, []string{"instance", "state"}),
+		stats: newStatMetrics(windowLabels),
+		bounceRate: prometheus.NewDesc("umami_website_bounce_rate",
+			"Ratio of visits that bounced (bounces / visits)", windowLabels, nil),
+		avgVisitDuration: prometheus.NewDesc("umami_website_avg_visit_duration_seconds",
+			"Average visit duration in seconds (totaltime / visits)", windowLabels, nil),
+		pagesPerVisit: prometheus.NewDesc("umami_website_pages_per_visit",
+			"Average pageviews per visit (pageviews / visits)", windowLabels, nil),
+		websiteActiveVisitors: prometheus.NewDesc("umami_website_active_visitors",
+			"Number of active visitors in last 5 minutes", websiteLabels, nil),
+		bucketPageviews: prometheus.NewDesc("umami_website_last_bucket_pageviews",
+			"Pageviews in the last complete time-series bucket of the given unit", bucketLabels, nil),
+		bucketSessions: prometheus.NewDesc("umami_website_last_bucket_sessions",
+			"Sessions in the last complete time-series bucket of the given unit", bucketLabels, nil),
+		bucketStart: prometheus.NewDesc("umami_website_last_bucket_start_timestamp_seconds",
+			"Unix timestamp of the start of the last complete time-series bucket of the given unit", bucketLabels, nil),
+		metricValue: prometheus.NewDesc("umami_metric_value",
+			"Metric value for a website for a given type and value (e.g. url /path => count)",
+			append(windowLabels, "type", "value"), nil),
+		eventPropertyValue: prometheus.NewDesc("umami_event_property_value",
+			"Number of times a custom event was recorded with a given property value",
+			append(windowLabels, "event", "property", "value"), nil),
+		websiteDataStale: prometheus.NewDesc("umami_website_data_stale",
+			"1 if some values for the website are carried over from a previous cycle because the last fetch failed", websiteLabels, nil),
+		websiteLastSuccess: prometheus.NewDesc("umami_website_last_success_timestamp_seconds",
+			"Unix timestamp of the last cycle in which all requests for the website succeeded", websiteLabels, nil),
+		metricValuesFolded: prometheus.NewDesc("umami_metric_values_folded",
+			"Number of metric and event property values summed into the __other__ bucket during the last cycle, by reason (top_n or budget)",
+			[]string{"instance", "reason"}, nil),
+		metricValueSeries: prometheus.NewDesc("umami_metric_value_series",
+			"Number of umami_metric_value and umami_event_property_value series currently exported", []string{"instance"}, nil),
 	}
-
-	prometheus.MustRegister(
-		m.FetchSuccess,
-		m.LastFetch,
-		m.WebsitePageviews,
-		m.WebsiteVisitors,
-		m.WebsiteVisits,
-		m.WebsiteBounces,
-		m.WebsiteTotaltimeSeconds,
-		m.WebsiteActiveVisitors,
-		m.MetricValues,
-	)
 	return m
 }
+
+// Publish atomically replaces the snapshot served to Prometheus for an instance.
+func (m *Metrics) Publish(instance string, s *Snapshot) {
+	if s == nil {
+		s = &Snapshot{}
+	}
+	m.mu.Lock()
+	m.snapshots[instance] = s
+	m.mu.Unlock()
+}
+
+// Snapshot returns the snapshot currently published for an instance.
+// It returns an empty snapshot if nothing was published yet.
+func (m *Metrics) Snapshot(instance string) *Snapshot {
+	m.mu.RLock()
+	s := m.snapshots[instance]
+	m.mu.RUnlock()
+	if s == nil {
+		return &Snapshot{}
+	}
+	return s
+}
+
+// Instances returns the sorted names of instances with a published snapshot.
+func (m *Metrics) Instances() []string {
+	m.mu.RLock()
+	out := make([]string, 0, len(m.snapshots))
+	for name := range m.snapshots {
+		out = append(out, name)
+	}
+	m.mu.RUnlock()
+	sort.Strings(out)
+	return out
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, sm := range m.stats {
+		sm.describe(ch)
+	}
+	ch <- m.bounceRate
+	ch <- m.avgVisitDuration
+	ch <- m.pagesPerVisit
+	ch <- m.websiteActiveVisitors
+	ch <- m.bucketPageviews
+	ch <- m.bucketSessions
+	ch <- m.bucketStart
+	ch <- m.metricValue
+	ch <- m.eventPropertyValue
+	ch <- m.websiteDataStale
+	ch <- m.websiteLastSuccess
+	ch <- m.metricValuesFolded
+	ch <- m.metricValueSeries
+}
+
+// Collect implements prometheus.Collector by emitting the current snapshots.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, instance := range m.Instances() {
+		m.collectSnapshot(ch, instance, m.Snapshot(instance))
+	}
+}
+
+// collectSnapshot emits the series of one instance snapshot.
+func (m *Metrics) collectSnapshot(ch chan<- prometheus.Metric, instance string, s *Snapshot) {
+	series := m.collectWebsites(ch, instance, s.Websites)
+	ch <- prometheus.MustNewConstMetric(m.metricValuesFolded, prometheus.GaugeValue, float64(s.FoldedTopN), instance, "top_n")
+	ch <- prometheus.MustNewConstMetric(m.metricValuesFolded, prometheus.GaugeValue, float64(s.FoldedBudget), instance, "budget")
+	ch <- prometheus.MustNewConstMetric(m.metricValueSeries, prometheus.GaugeValue, float64(series), instance)
+}
+
+// collectWebsites emits the per-website series and returns the number of
+// metric and event property value series emitted.
+func (m *Metrics) collectWebsites(ch chan<- prometheus.Metric, instance string, websites []WebsiteSnapshot) int {
+	series := 0
+	for _, w := range websites {
+		lv := m.labelValues(instance, w)
+		if w.Active != nil {
+			ch <- prometheus.MustNewConstMetric(m.websiteActiveVisitors, prometheus.GaugeValue, *w.Active, lv...)
+		}
+		for _, b := range w.Buckets {
+			blv := append(lv, b.Unit)
+			ch <- prometheus.MustNewConstMetric(m.bucketPageviews, prometheus.GaugeValue, b.Pageviews, blv...)
+			ch <- prometheus.MustNewConstMetric(m.bucketSessions, prometheus.GaugeValue, b.Sessions, blv...)
+			ch <- prometheus.MustNewConstMetric(m.bucketStart, prometheus.GaugeValue, float64(b.Start.Unix()), blv...)
+		}
+		for _, win := range w.Windows {
+			wlv := append(lv, win.Name)
+			if win.Stats != nil {
+				for _, sm := range m.stats {
+					sm.collect(ch, win.Stats, wlv)
+				}
+			}
+			if e := win.Engagement; e != nil {
+				ch <- prometheus.MustNewConstMetric(m.bounceRate, prometheus.GaugeValue, e.BounceRate, wlv...)
+				ch <- prometheus.MustNewConstMetric(m.avgVisitDuration, prometheus.GaugeValue, e.AvgVisitDurationSeconds, wlv...)
+				ch <- prometheus.MustNewConstMetric(m.pagesPerVisit, prometheus.GaugeValue, e.PagesPerVisit, wlv...)
+			}
+			for _, mv := range win.Metrics {
+				ch <- prometheus.MustNewConstMetric(m.metricValue, prometheus.GaugeValue, mv.Count, append(wlv, mv.Type, mv.Value)...)
+			}
+			for _, ev := range win.EventProperties {
+				ch <- prometheus.MustNewConstMetric(m.eventPropertyValue, prometheus.GaugeValue, ev.Count, append(wlv, ev.Event, ev.Property, ev.Value)...)
+			}
+			series += len(win.Metrics) + len(win.EventProperties)
+		}
+		stale := 0.0
+		if w.Stale {
+			stale = 1
+		}
+		ch <- prometheus.MustNewConstMetric(m.websiteDataStale, prometheus.GaugeValue, stale, lv...)
+		if !w.LastSuccess.IsZero() {
+			ch <- prometheus.MustNewConstMetric(m.websiteLastSuccess, prometheus.GaugeValue, float64(w.LastSuccess.Unix()), lv...)
+		}
+	}
+	return series
+}
+
+// WebsiteCollector returns a collector emitting the series of a single website
+// of an instance, without the per-cycle series. It is used to serve probes.
+func (m *Metrics) WebsiteCollector(instance string, w WebsiteSnapshot) prometheus.Collector {
+	return &websiteCollector{m: m, instance: instance, w: w}
+}
+
+type websiteCollector struct {
+	m        *Metrics
+	instance string
+	w        WebsiteSnapshot
+}
+
+func (c *websiteCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.m.Describe(ch)
+}
+
+func (c *websiteCollector) Collect(ch chan<- prometheus.Metric) {
+	c.m.collectWebsites(ch, c.instance, []WebsiteSnapshot{c.w})
+}
+
+// labelValues returns the website label values in descriptor order.
+// The returned slice has no spare capacity so callers may append to it safely.
+func (m *Metrics) labelValues(instance string, w WebsiteSnapshot) []string {
+	lv := make([]string, 0, 4+len(m.extraLabels))
+	lv = append(lv, instance, w.ID, w.Name, w.Domain)
+	for _, k := range m.extraLabels {
+		lv = append(lv, w.Labels[k])
+	}
+	return lv[:len(lv):len(lv)]
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// cycleFamilies are families describing the update cycle itself rather than
+// website data; they are meaningless for historical snapshots.
+var cycleFamilies = map[string]struct{}{
+	"umami_website_data_stale":   {},
+	"umami_metric_values_folded": {},
+	"umami_metric_value_series":  {},
+}
+
+// Recorder accumulates snapshots taken at explicit timestamps and writes them
+// in the OpenMetrics format accepted by `promtool tsdb create-blocks-from
+// openmetrics`. Series use the same names and labels as Metrics.
+type Recorder struct {
+	m        *Metrics
+	families map[string]*dto.MetricFamily
+	order    []string
+}
+
+// NewRecorder creates a Recorder. Unlike New, it registers nothing.
+func NewRecorder(extraLabels []string) *Recorder {
+	return &Recorder{
+		m:        newMetrics(extraLabels),
+		families: make(map[string]*dto.MetricFamily),
+	}
+}
+
+// Record adds the series of s, timestamped at ts. Snapshots must be recorded in
+// chronological order for each series.
+func (r *Recorder) Record(instance string, s *Snapshot, ts time.Time) error {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(&timestampedSnapshot{m: r.m, instance: instance, s: s, ts: ts}); err != nil {
+		return err
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range mfs {
+		if _, skip := cycleFamilies[mf.GetName()]; skip {
+			continue
+		}
+		if f, ok := r.families[mf.GetName()]; ok {
+			f.Metric = append(f.Metric, mf.Metric...)
+			continue
+		}
+		r.families[mf.GetName()] = mf
+		r.order = append(r.order, mf.GetName())
+	}
+	return nil
+}
+
+// Write writes the recorded series, one family at a time, followed by the
+// OpenMetrics EOF marker.
+func (r *Recorder) Write(w io.Writer) error {
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeOpenMetrics))
+	for _, name := range r.order {
+		if err := enc.Encode(r.families[name]); err != nil {
+			return err
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(w)
+	return err
+}
+
+// timestampedSnapshot collects a single snapshot with an explicit timestamp.
+type timestampedSnapshot struct {
+	m        *Metrics
+	instance string
+	s        *Snapshot
+	ts       time.Time
+}
+
+func (t *timestampedSnapshot) Describe(ch chan<- *prometheus.Desc) {
+	t.m.Describe(ch)
+}
+
+func (t *timestampedSnapshot) Collect(ch chan<- prometheus.Metric) {
+	inner := make(chan prometheus.Metric)
+	go func() {
+		t.m.collectSnapshot(inner, t.instance, t.s)
+		close(inner)
+	}()
+	for metric := range inner {
+		ch <- prometheus.NewMetricWithTimestamp(t.ts, metric)
+	}
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+)
+
+// APIObserver records the requests of the Umami client of one instance. It
+// implements umami.Observer.
+type APIObserver struct {
+	m        *Metrics
+	instance string
+}
+
+// APIObserver returns the observer recording API requests for instance.
+func (m *Metrics) APIObserver(instance string) *APIObserver {
+	return &APIObserver{m: m, instance: instance}
+}
+
+// ObserveRequest records one API request.
+func (o *APIObserver) ObserveRequest(endpoint, method string, status int, d time.Duration) {
+	class := statusClass(status)
+	o.m.APIRequestDuration.WithLabelValues(o.instance, endpoint, method, class).Observe(d.Seconds())
+	o.m.APIRequests.WithLabelValues(o.instance, endpoint, method, class).Inc()
+}
+
+// ObserveLogin records one login attempt.
+func (o *APIObserver) ObserveLogin(relogin bool, err error) {
+	reason, result := "initial", "success"
+	if relogin {
+		reason = "relogin"
+	}
+	if err != nil {
+		result = "failure"
+	}
+	o.m.APILogins.WithLabelValues(o.instance, reason, result).Inc()
+}
+
+// ObserveCircuitState records the state of the circuit breaker.
+func (o *APIObserver) ObserveCircuitState(state string) {
+	for _, s := range circuitStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		o.m.CircuitState.WithLabelValues(o.instance, s).Set(v)
+	}
+}
+
+// circuitStates lists the states of umami.Client circuit breakers.
+var circuitStates = []string{"closed", "open", "half_open"}
+
+// statusClass returns the class of an HTTP status ("2xx", "4xx", ...), or
+// "error" when no response was received.
+func statusClass(status int) string {
+	if status <= 0 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import "time"
+
+// Snapshot is an immutable view of the data gathered during one update cycle.
+// Once handed to Metrics.Publish it must not be modified.
+type Snapshot struct {
+	Websites []WebsiteSnapshot
+
+	// FoldedTopN and FoldedBudget count the metric values summed into the
+	// "__other__" bucket by the per-type top-N limit and the series budget.
+	FoldedTopN   int
+	FoldedBudget int
+}
+
+// WebsiteSnapshot holds everything collected for a single website.
+type WebsiteSnapshot struct {
+	ID     string
+	Name   string
+	Domain string
+	// Labels holds values of the extra labels configured for the website.
+	Labels map[string]string
+
+	// Active is nil when no active visitors count is available.
+	Active *float64
+	// Windows holds stats and metrics for each configured time window.
+	Windows []WindowSnapshot
+	// Buckets holds the last complete time-series bucket of each configured unit.
+	Buckets []BucketSnapshot
+
+	// Stale is true when some of the values above are carried over from an
+	// earlier cycle because the latest fetch for this website failed.
+	Stale bool
+	// LastSuccess is the time of the last cycle in which every request for this
+	// website succeeded. It is zero if that never happened.
+	LastSuccess time.Time
+}
+
+// WindowSnapshot holds the values of one website for one named time window.
+type WindowSnapshot struct {
+	Name string
+
+	// Stats is nil when no stats are available for the window.
+	Stats *Stats
+	// Engagement is derived from Stats; it is nil when Stats is nil or has no visits.
+	Engagement *Engagement
+	// Metrics holds entries of the generic /metrics endpoint, one per type and value.
+	Metrics []MetricValue
+	// EventProperties holds values of the configured custom event properties.
+	EventProperties []EventPropertyValue
+	// Folded is the number of values of Metrics and EventProperties folded by
+	// the top-N limit.
+	Folded int
+}
+
+// BucketSnapshot holds the pageviews and sessions of one complete time-series bucket.
+type BucketSnapshot struct {
+	Unit      string
+	Start     time.Time
+	Pageviews float64
+	Sessions  float64
+}
+
+// Stats mirrors the summarized values returned by the Umami /stats endpoint.
+type Stats struct {
+	Pageviews StatValue
+	Visitors  StatValue
+	Visits    StatValue
+	Bounces   StatValue
+	Totaltime StatValue
+}
+
+// StatValue holds the value of a stat for a window and for the period of the
+// same length preceding it.
+type StatValue struct {
+	Value float64
+	Prev  float64
+}
+
+// Engagement holds ratios derived from the Stats of the same window.
+type Engagement struct {
+	BounceRate              float64
+	AvgVisitDurationSeconds float64
+	PagesPerVisit           float64
+}
+
+// MetricValue is one entry of a metric type (e.g. url /path => count).
+type MetricValue struct {
+	Type  string
+	Value string
+	Count float64
+}
+
+// EventPropertyValue is one value of a custom event property with the number of
+// times it was recorded.
+type EventPropertyValue struct {
+	Event    string
+	Property string
+	Value    string
+	Count    float64
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// statMetric describes the series exported for one field of Stats: the value of
+// the window, the value of the previous period of the same length, and the
+// relative change between both.
+type statMetric struct {
+	value       *prometheus.Desc
+	previous    *prometheus.Desc
+	changeRatio *prometheus.Desc
+	get         func(*Stats) StatValue
+}
+
+func newStatMetric(name, ratioName, help string, labels []string, get func(*Stats) StatValue) statMetric {
+	return statMetric{
+		value: prometheus.NewDesc(name, help+" (current value)", labels, nil),
+		previous: prometheus.NewDesc(name+"_previous",
+			help+" for the period preceding the window", labels, nil),
+		changeRatio: prometheus.NewDesc(ratioName,
+			help+": relative change from the previous period ((current-previous)/previous), absent when previous is 0", labels, nil),
+		get: get,
+	}
+}
+
+// newStatMetrics returns the stat metrics exported for every window.
+func newStatMetrics(labels []string) []statMetric {
+	return []statMetric{
+		newStatMetric("umami_website_pageviews", "umami_website_pageviews_change_ratio",
+			"Pageviews for website", labels, func(s *Stats) StatValue { return s.Pageviews }),
+		newStatMetric("umami_website_visitors", "umami_website_visitors_change_ratio",
+			"Visitors for website", labels, func(s *Stats) StatValue { return s.Visitors }),
+		newStatMetric("umami_website_visits", "umami_website_visits_change_ratio",
+			"Visits for website", labels, func(s *Stats) StatValue { return s.Visits }),
+		newStatMetric("umami_website_bounces", "umami_website_bounces_change_ratio",
+			"Bounces for website", labels, func(s *Stats) StatValue { return s.Bounces }),
+		newStatMetric("umami_website_totaltime_seconds", "umami_website_totaltime_change_ratio",
+			"Total time spent on website in seconds", labels, func(s *Stats) StatValue { return s.Totaltime }),
+	}
+}
+
+func (sm statMetric) describe(ch chan<- *prometheus.Desc) {
+	ch <- sm.value
+	ch <- sm.previous
+	ch <- sm.changeRatio
+}
+
+func (sm statMetric) collect(ch chan<- prometheus.Metric, st *Stats, lv []string) {
+	v := sm.get(st)
+	ch <- prometheus.MustNewConstMetric(sm.value, prometheus.GaugeValue, v.Value, lv...)
+	ch <- prometheus.MustNewConstMetric(sm.previous, prometheus.GaugeValue, v.Prev, lv...)
+	if v.Prev != 0 {
+		ch <- prometheus.MustNewConstMetric(sm.changeRatio, prometheus.GaugeValue, (v.Value-v.Prev)/v.Prev, lv...)
+	}
+}
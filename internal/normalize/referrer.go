@@ -0,0 +1,107 @@
+package normalize
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Referrer grouping modes.
+const (
+	// ReferrerRaw exports referrer entries as returned by Umami.
+	ReferrerRaw = "raw"
+	// ReferrerDomain exports referrers grouped by domain instead of raw entries.
+	ReferrerDomain = "domain"
+	// ReferrerBoth exports grouped domains alongside the raw entries.
+	ReferrerBoth = "both"
+)
+
+// ReferrerRules configures the reduction of referrer entries to domains.
+type ReferrerRules struct {
+	// Mode is one of ReferrerRaw (default), ReferrerDomain or ReferrerBoth.
+	Mode string `yaml:"mode"`
+	// Mappings rename domains matching a glob pattern (e.g. "google.*" => "google").
+	// The first matching mapping wins.
+	Mappings []ReferrerMapping `yaml:"mappings"`
+}
+
+// ReferrerMapping maps domains matching Match (a path.Match pattern tested
+// against the host and its registrable domain) to Name.
+type ReferrerMapping struct {
+	Match string `yaml:"match"`
+	Name  string `yaml:"name"`
+}
+
+// Enabled reports whether referrers are grouped by domain.
+func (r ReferrerRules) Enabled() bool {
+	return r.Mode == ReferrerDomain || r.Mode == ReferrerBoth
+}
+
+// ReferrerGrouper reduces referrer entries to registrable domains.
+// It is safe for concurrent use.
+type ReferrerGrouper struct {
+	rules ReferrerRules
+}
+
+// Compile validates the rules and returns a grouper.
+func (r ReferrerRules) Compile() (*ReferrerGrouper, error) {
+	switch r.Mode {
+	case "", ReferrerRaw, ReferrerDomain, ReferrerBoth:
+	default:
+		return nil, fmt.Errorf("referrer mode %q: must be %s, %s or %s", r.Mode, ReferrerRaw, ReferrerDomain, ReferrerBoth)
+	}
+	for i, m := range r.Mappings {
+		if _, err := path.Match(m.Match, ""); err != nil {
+			return nil, fmt.Errorf("referrer mapping %d: %w", i, err)
+		}
+		if m.Name == "" {
+			return nil, fmt.Errorf("referrer mapping %d: name is required", i)
+		}
+	}
+	return &ReferrerGrouper{rules: r}, nil
+}
+
+// KeepRaw reports whether raw referrer entries are exported as well.
+func (g *ReferrerGrouper) KeepRaw() bool {
+	return g == nil || g.rules.Mode != ReferrerDomain
+}
+
+// Domain returns the group of a referrer, which may be a full URL or a bare host.
+// The group is the name of the first matching mapping, or else the registrable
+// domain (e.g. "https://www.google.co.uk/search?q=x" => "google.co.uk").
+// It returns an empty string for empty referrers.
+func (g *ReferrerGrouper) Domain(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+
+	host := raw
+	if strings.Contains(raw, "://") {
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			host = u.Hostname()
+		}
+	} else if i := strings.IndexAny(raw, "/?#:"); i >= 0 {
+		host = raw[:i]
+	}
+	host = strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(host, ".")), "www.")
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		// IP addresses, localhost and bare suffixes have no registrable domain
+		domain = host
+	}
+
+	for _, m := range g.rules.Mappings {
+		if ok, _ := path.Match(m.Match, host); ok {
+			return m.Name
+		}
+		if ok, _ := path.Match(m.Match, domain); ok {
+			return m.Name
+		}
+	}
+	return domain
+}
@@ -0,0 +1,94 @@
+// Package normalize rewrites raw metric values returned by Umami (URLs,
+// referrers) into groupable label values.
+package normalize
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// URLRules configures how entries of the url metric type are normalized.
+// Rules are applied in this order: query string stripping, trailing slash
+// folding, ID collapsing, then regex rewrites.
+type URLRules struct {
+	// StripQuery removes the query string and fragment ("/a?ref=x#top" => "/a").
+	StripQuery bool `yaml:"strip_query"`
+	// TrailingSlash folds "/a/" into "/a". The root path "/" is kept.
+	TrailingSlash bool `yaml:"trailing_slash"`
+	// CollapseIDs replaces path segments that look like identifiers (numbers,
+	// UUIDs, long hexadecimal hashes) with ":id".
+	CollapseIDs bool `yaml:"collapse_ids"`
+	// Rewrites are regular expression replacements applied in order.
+	Rewrites []Rewrite `yaml:"rewrites"`
+}
+
+// Rewrite replaces every match of Match with Replace, which may reference
+// capture groups as in regexp.Regexp.ReplaceAllString (e.g. "/blog/:slug" or "/$1").
+type Rewrite struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+// Enabled reports whether any rule is configured.
+func (r URLRules) Enabled() bool {
+	return r.StripQuery || r.TrailingSlash || r.CollapseIDs || len(r.Rewrites) > 0
+}
+
+// URLNormalizer applies compiled URLRules. It is safe for concurrent use.
+type URLNormalizer struct {
+	rules    URLRules
+	rewrites []*regexp.Regexp
+}
+
+// Compile validates the rules and returns a normalizer.
+func (r URLRules) Compile() (*URLNormalizer, error) {
+	n := &URLNormalizer{rules: r}
+	for i, rw := range r.Rewrites {
+		re, err := regexp.Compile(rw.Match)
+		if err != nil {
+			return nil, fmt.Errorf("url rewrite %d: %w", i, err)
+		}
+		n.rewrites = append(n.rewrites, re)
+	}
+	return n, nil
+}
+
+var (
+	numericID = regexp.MustCompile(`^[0-9]+$`)
+	uuidID    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexID     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// Normalize returns the templated form of a URL path. A nil normalizer returns
+// the input unchanged.
+func (n *URLNormalizer) Normalize(s string) string {
+	if n == nil {
+		return s
+	}
+	if n.rules.StripQuery {
+		if i := strings.IndexAny(s, "?#"); i >= 0 {
+			s = s[:i]
+		}
+	}
+	if n.rules.TrailingSlash {
+		if t := strings.TrimRight(s, "/"); t != "" {
+			s = t
+		} else if s != "" {
+			s = "/"
+		}
+	}
+	if n.rules.CollapseIDs {
+		segs := strings.Split(s, "/")
+		for i, seg := range segs {
+			if numericID.MatchString(seg) || uuidID.MatchString(seg) || hexID.MatchString(seg) {
+				segs[i] = ":id"
+			}
+		}
+		s = strings.Join(segs, "/")
+	}
+	for i, re := range n.rewrites {
+		s = re.ReplaceAllString(s, n.rules.Rewrites[i].Replace)
+	}
+	return s
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/updater"
+)
+
+// livezHandler serves /livez, failing when the update loop of an instance is
+// wedged. Umami being unreachable does not make the exporter unhealthy.
+func livezHandler(updaters []*updater.Updater) http.HandlerFunc {
+	return checkHandler(updaters, "update loop wedged", (*updater.Updater).Alive)
+}
+
+// readyzHandler serves /readyz, failing until every instance completed a cycle
+// and while the data of one of them is too old.
+func readyzHandler(updaters []*updater.Updater) http.HandlerFunc {
+	return checkHandler(updaters, "no recent successful update", (*updater.Updater).Ready)
+}
+
+// checkHandler answers 200 "ok" when check passes for every updater, and 503
+// listing the failing instances otherwise.
+func checkHandler(updaters []*updater.Updater, reason string, check func(*updater.Updater, time.Time) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		var failing []string
+		for _, u := range updaters {
+			if !check(u, now) {
+				failing = append(failing, u.Name())
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(failing) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%s: %s\n", reason, strings.Join(failing, ", "))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// statusHandler serves /status, the detailed state of every instance as JSON.
+func statusHandler(updaters []*updater.Updater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type resp struct {
+			Alive     bool             `json:"alive"`
+			Ready     bool             `json:"ready"`
+			Instances []updater.Status `json:"instances"`
+		}
+		now := time.Now()
+		res := resp{Alive: true, Ready: true, Instances: make([]updater.Status, 0, len(updaters))}
+		for _, u := range updaters {
+			st := u.Status(now)
+			res.Alive = res.Alive && st.Alive
+			res.Ready = res.Ready && st.Ready
+			res.Instances = append(res.Instances, st)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(res)
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/config"
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/umami"
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/updater"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultProbeTimeout bounds probes when Prometheus does not send its scrape timeout.
+const defaultProbeTimeout = 10 * time.Second
+
+// probeWriteTime is the time left to write the response of a probe once it
+// timed out.
+const probeWriteTime = 5 * time.Second
+
+// probeHandler serves /probe?website_id=...&window=...&instance=..., collecting a
+// single website on demand in the style of blackbox_exporter. window defaults to
+// the windows configured for the website and instance may be omitted when a
+// single instance is configured.
+func probeHandler(m *prommetrics.Metrics, updaters []*updater.Updater, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		id := q.Get("website_id")
+		if id == "" {
+			http.Error(w, "website_id parameter is required", http.StatusBadRequest)
+			return
+		}
+		// the ID ends up in the path of requests sent with the exporter's credentials
+		if !umami.IsID(id) {
+			http.Error(w, "website_id parameter must be an Umami website ID", http.StatusBadRequest)
+			return
+		}
+
+		var window *config.Window
+		if s := q.Get("window"); s != "" {
+			win, err := config.ParseWindow(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("window parameter: %v", err), http.StatusBadRequest)
+				return
+			}
+			window = &win
+		}
+
+		upd, err := findUpdater(updaters, q.Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		timeout := probeTimeout(r)
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		// Probes may last longer than the WriteTimeout of the server
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + probeWriteTime)); err != nil {
+			logger.Printf("server: probe %s: cannot extend write deadline: %v", id, err)
+		}
+
+		probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "umami_probe_success",
+			Help: "1 if every request of the probe succeeded, 0 otherwise",
+		})
+		probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "umami_probe_duration_seconds",
+			Help: "Duration of the probe in seconds, close to 0 when served from cache",
+		})
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(probeSuccess, probeDuration)
+
+		start := time.Now()
+		ws, err := upd.Probe(ctx, id, window)
+		probeDuration.Set(time.Since(start).Seconds())
+		if err != nil {
+			logger.Printf("server: probe %s error: %v", id, err)
+		} else {
+			probeSuccess.Set(1)
+		}
+		if ws.ID != "" {
+			reg.MustRegister(m.WebsiteCollector(upd.Name(), ws))
+		}
+
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
+// findUpdater returns the updater of the named instance, or the only one when
+// name is empty.
+func findUpdater(updaters []*updater.Updater, name string) (*updater.Updater, error) {
+	if name == "" {
+		if len(updaters) != 1 {
+			return nil, fmt.Errorf("instance parameter is required when several instances are configured")
+		}
+		return updaters[0], nil
+	}
+	for _, u := range updaters {
+		if u.Name() == name {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown instance %q", name)
+}
+
+// probeTimeout returns the time left for a probe, taken from the scrape timeout
+// sent by Prometheus minus a small margin to write the response.
+func probeTimeout(r *http.Request) time.Duration {
+	if v, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64); err == nil && v > 0 {
+		if d := time.Duration(v*float64(time.Second)) - 500*time.Millisecond; d > 0 {
+			return d
+		}
+	}
+	return defaultProbeTimeout
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/updater"
+)
+
+// targetGroup is one entry of the Prometheus http_sd_config format.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdHandler serves /sd, listing the websites of every instance (or of the one
+// named by the instance parameter) in the Prometheus http_sd_config format.
+// Targets are website IDs, ready to be passed to /probe, or domains with
+// target=domain, e.g. for blackbox_exporter.
+func sdHandler(updaters []*updater.Updater, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		target := q.Get("target")
+		switch target {
+		case "":
+			target = "id"
+		case "id", "domain":
+		default:
+			http.Error(w, fmt.Sprintf("target parameter %q: must be id or domain", target), http.StatusBadRequest)
+			return
+		}
+
+		selected := updaters
+		if name := q.Get("instance"); name != "" {
+			u, err := findUpdater(updaters, name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			selected = []*updater.Updater{u}
+		}
+
+		groups := []targetGroup{}
+		for _, u := range selected {
+			websites, err := u.Websites(r.Context())
+			if err != nil {
+				logger.Printf("server: sd instance %s error: %v", u.Name(), err)
+				http.Error(w, "failed to list websites", http.StatusBadGateway)
+				return
+			}
+			for _, site := range websites {
+				t := site.ID
+				if target == "domain" {
+					t = site.Domain
+				}
+				if t == "" {
+					continue
+				}
+				groups = append(groups, targetGroup{
+					Targets: []string{t},
+					Labels: map[string]string{
+						"__meta_umami_instance":       u.Name(),
+						"__meta_umami_website_id":     site.ID,
+						"__meta_umami_website_name":   site.Name,
+						"__meta_umami_website_domain": site.Domain,
+						"__meta_umami_website_team":   site.TeamID,
+					},
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(groups)
+	}
+}
@@ -3,41 +3,71 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
 	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/updater"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 )
 
-// NewHTTPServer builds an *http.Server serving /metrics and /healthz.
+// NewHTTPServer builds an *http.Server serving /metrics, /probe, /sd, /livez,
+// /readyz, /status and /healthz.
 // addr should be in the form ":9465" or "0.0.0.0:9465".
-func NewHTTPServer(addr string, u *updater.Updater, logger *log.Logger) *http.Server {
+// /healthz reports healthy only when the last cycle of every updater running a
+// loop succeeded, along with the circuit breaker state of every instance. It is
+// kept for compatibility; /livez and /readyz are meant for liveness and
+// readiness probes.
+func NewHTTPServer(addr string, m *prommetrics.Metrics, updaters []*updater.Updater, logger *log.Logger) *http.Server {
 	if logger == nil {
 		logger = log.Default()
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/probe", probeHandler(m, updaters, logger))
+	mux.HandleFunc("/sd", sdHandler(updaters, logger))
+	mux.HandleFunc("/livez", livezHandler(updaters))
+	mux.HandleFunc("/readyz", readyzHandler(updaters))
+	mux.HandleFunc("/status", statusHandler(updaters))
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		last := int64(0)
-		success := false
-		if u != nil {
-			last = u.LastFetchUnix()
-			success = u.LastSuccess()
+		type instanceResp struct {
+			LastFetch int64  `json:"last_fetch"`
+			Success   bool   `json:"success"`
+			Circuit   string `json:"circuit"`
 		}
 		type resp struct {
-			LastFetch int64 `json:"last_fetch"`
-			Success   bool  `json:"success"`
+			LastFetch int64                   `json:"last_fetch"`
+			Success   bool                    `json:"success"`
+			Instances map[string]instanceResp `json:"instances"`
 		}
-		res := resp{LastFetch: last, Success: success}
-		if !success {
+		res := resp{Success: len(updaters) > 0, Instances: make(map[string]instanceResp, len(updaters))}
+		first := true
+		for _, u := range updaters {
+			// probe-only instances have no update cycle to report on
+			if u.ProbeOnly() {
+				continue
+			}
+			last := u.LastFetchUnix()
+			success := u.LastSuccess()
+			res.Instances[u.Name()] = instanceResp{LastFetch: last, Success: success, Circuit: u.CircuitState()}
+			// last_fetch is the oldest successful fetch across instances
+			if first || last < res.LastFetch {
+				res.LastFetch = last
+			}
+			first = false
+			res.Success = res.Success && success
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !res.Success {
 			w.WriteHeader(http.StatusServiceUnavailable)
 		} else {
 			w.WriteHeader(http.StatusOK)
 		}
-		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(res)
 	})
 
@@ -52,6 +82,30 @@ func NewHTTPServer(addr string, u *updater.Updater, logger *log.Logger) *http.Se
 	return srv
 }
 
+// ListenAndServe serves srv on its address. When webConfigFile is not empty,
+// TLS, client certificate authentication and basic authentication are set up
+// from that exporter-toolkit web configuration file
+// (https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md).
+// The file is read again for every new connection and request, so certificate
+// and user changes apply without a restart.
+func ListenAndServe(srv *http.Server, webConfigFile string, logger *log.Logger) error {
+	if logger == nil {
+		logger = log.Default()
+	}
+	if webConfigFile != "" {
+		if err := web.Validate(webConfigFile); err != nil {
+			return fmt.Errorf("web config file %s: %w", webConfigFile, err)
+		}
+	}
+	systemdSocket := false
+	flags := &web.FlagConfig{
+		WebListenAddresses: &[]string{srv.Addr},
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &webConfigFile,
+	}
+	return web.ListenAndServe(srv, flags, slog.New(slog.NewTextHandler(logger.Writer(), nil)))
+}
+
 // Shutdown attempts a graceful shutdown with the given timeout.
 func Shutdown(ctx context.Context, srv *http.Server, logger *log.Logger) error {
 	if logger == nil {
@@ -0,0 +1,131 @@
+package umami
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting Umami while the circuit
+// breaker of a client is open.
+var ErrCircuitOpen = errors.New("umami: circuit breaker open")
+
+// Circuit breaker states, as reported by Client.CircuitState.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// breaker is a circuit breaker. It opens after threshold consecutive failed
+// requests, i.e. network errors and 5xx responses, and then rejects requests
+// for cooldown. The first request after the cooldown is let through as a probe
+// (half-open state): its success closes the breaker and its failure opens it
+// again. A nil breaker never rejects requests.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	onChange  func(state string)
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// SetCircuitBreaker makes the client stop contacting Umami for cooldown after
+// threshold consecutive failed requests, retries and logins included.
+// threshold <= 0 disables the breaker. It must be called before the client is
+// used, and after SetObserver for the observer to be notified of its state.
+func (c *Client) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	if threshold <= 0 {
+		c.breaker = nil
+		return
+	}
+	b := &breaker{threshold: threshold, cooldown: cooldown, state: CircuitClosed}
+	if c.observer != nil {
+		b.onChange = c.observer.ObserveCircuitState
+		b.onChange(b.state)
+	}
+	c.breaker = b
+}
+
+// CircuitState returns the state of the circuit breaker, CircuitClosed when
+// it is disabled.
+func (c *Client) CircuitState() string {
+	if c.breaker == nil {
+		return CircuitClosed
+	}
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+	return c.breaker.state
+}
+
+// allow reports whether a request may be sent and whether it is the probe of
+// a half-open breaker, moving an open breaker whose cooldown elapsed to
+// half-open. Every allowed request must be followed by a call to done.
+func (b *breaker) allow() (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false, ErrCircuitOpen
+		}
+		b.setState(CircuitHalfOpen)
+	case CircuitHalfOpen:
+		if b.probing {
+			return false, ErrCircuitOpen
+		}
+	default:
+		return false, nil
+	}
+	b.probing = true
+	return true, nil
+}
+
+// done records the outcome of an allowed request. Requests aborted by their
+// context say nothing about Umami and leave the breaker unchanged.
+func (b *breaker) done(ctx context.Context, probe bool, resp *http.Response, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	if err == nil && resp.StatusCode < 500 {
+		b.failures = 0
+		if probe {
+			b.setState(CircuitClosed)
+		}
+		return
+	}
+	b.failures++
+	if probe || (b.state == CircuitClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.setState(CircuitOpen)
+	}
+}
+
+// setState changes the state and notifies onChange. b.mu must be held.
+func (b *breaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
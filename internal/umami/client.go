@@ -4,26 +4,57 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// CloudURL is the API base URL of Umami Cloud.
+const CloudURL = "https://api.umami.is/v1"
+
 // Client is a thin Umami API client used by the exporter.
-// It is safe for concurrent use.
+// It authenticates either with username/password (self-hosted instances) or with
+// an API key (Umami Cloud). It is safe for concurrent use.
 type Client struct {
 	baseURL    string
 	username   string
 	password   string
+	apiKey     string
 	httpClient *http.Client
 
+	// pathPrefix is prepended to every API path: self-hosted instances serve the
+	// API under /api while Umami Cloud serves it at the root of CloudURL.
+	pathPrefix string
+
 	mu    sync.RWMutex
 	token string
+
+	observer Observer
+	retry    RetryPolicy
+	limiter  *limiter
+	breaker  *breaker
+}
+
+// Observer receives the outcome of the requests made by a Client, e.g. to
+// export them as metrics. Implementations must be safe for concurrent use.
+type Observer interface {
+	// ObserveRequest is called once per HTTP request with the templated API
+	// path (e.g. "/websites/:id/stats"), the HTTP status code (0 when no
+	// response was received) and the request duration.
+	ObserveRequest(endpoint, method string, status int, d time.Duration)
+	// ObserveLogin is called once per login attempt. relogin is true when the
+	// login was triggered by a 401 on an expired token.
+	ObserveLogin(relogin bool, err error)
+	// ObserveCircuitState is called with the initial state of the circuit
+	// breaker and on every change (CircuitClosed, CircuitOpen or CircuitHalfOpen).
+	ObserveCircuitState(state string)
 }
 
 // New creates a new Umami API client. If httpClient is nil a default one is created.
@@ -37,16 +68,75 @@ func New(baseURL, username, password string, httpClient *http.Client) *Client {
 		username:   username,
 		password:   password,
 		httpClient: httpClient,
+		pathPrefix: "/api",
 	}
 }
 
+// NewWithAPIKey creates a client authenticating with the x-umami-api-key header,
+// as required by Umami Cloud. baseURL defaults to CloudURL when empty.
+// If httpClient is nil a default one is created.
+func NewWithAPIKey(baseURL, apiKey string, httpClient *http.Client) *Client {
+	if baseURL == "" {
+		baseURL = CloudURL
+	}
+	baseURL = strings.TrimRight(baseURL, "/")
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 15 * time.Second}
+	}
+	return &Client{
+		baseURL:    baseURL,
+		apiKey:     apiKey,
+		httpClient: httpClient,
+	}
+}
+
+// SetObserver sets the observer notified of every request. It must be called
+// before the client is used.
+func (c *Client) SetObserver(o Observer) {
+	c.observer = o
+}
+
+// APIError is returned when the Umami API answers with an error status.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("request failed: %s %s status=%d body=%s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
 // Website represents a Umami tracked website.
 type Website struct {
 	ID     string `json:"id"`
 	Name   string `json:"name"`
 	Domain string `json:"domain"`
+	TeamID string `json:"teamId"`
+}
+
+// Team represents a Umami team the authenticated user belongs to.
+type Team struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
 }
 
+// idPattern matches the UUIDs Umami uses as website and team IDs.
+var idPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// IsID reports whether s has the format of an Umami website or team ID.
+func IsID(s string) bool {
+	return idPattern.MatchString(s)
+}
+
+// pageSize is the number of items requested per page from list endpoints and
+// maxPages guards against servers that ignore the page parameter.
+const (
+	pageSize = 100
+	maxPages = 1000
+)
+
 // StatValue represents a value with a previous value returned by Umami stats endpoints.
 type StatValue struct {
 	Value float64 `json:"value"`
@@ -68,10 +158,49 @@ type MetricEntry struct {
 	Y float64 `json:"y"`
 }
 
+// PageviewSeries holds the bucketed pageviews and sessions returned by /pageviews.
+// Each entry's X is the start of the bucket and Y its count.
+type PageviewSeries struct {
+	Pageviews []MetricEntry `json:"pageviews"`
+	Sessions  []MetricEntry `json:"sessions"`
+}
+
+// EventDataEvent is one event/property pair returned by the event-data/events endpoint.
+type EventDataEvent struct {
+	EventName    string  `json:"eventName"`
+	PropertyName string  `json:"propertyName"`
+	DataType     int     `json:"dataType"`
+	Total        float64 `json:"total"`
+}
+
+// EventDataValue is one value of an event property returned by the
+// event-data/values endpoint. Value is decoded as-is since Umami returns
+// strings, numbers or booleans depending on the property data type.
+type EventDataValue struct {
+	Value interface{} `json:"value"`
+	Total float64     `json:"total"`
+}
+
 // Login authenticates against Umami and stores the token in the client.
 // The function is resilient and will try to discover common token keys in a JSON response
-// or accept a raw string body.
+// or accept a raw string body. It is a no-op for clients using an API key.
 func (c *Client) Login(ctx context.Context) error {
+	return c.login(ctx, false)
+}
+
+// login performs Login and reports the attempt to the observer.
+func (c *Client) login(ctx context.Context, relogin bool) error {
+	if c.apiKey != "" {
+		return nil
+	}
+	err := c.doLogin(ctx)
+	if c.observer != nil {
+		c.observer.ObserveLogin(relogin, err)
+	}
+	return err
+}
+
+func (c *Client) doLogin(ctx context.Context) error {
 	payload := map[string]string{
 		"username": c.username,
 		"password": c.password,
@@ -81,14 +210,14 @@ func (c *Client) Login(ctx context.Context) error {
 		return err
 	}
 
-	u := c.baseURL + "/api/auth/login"
+	u := c.baseURL + c.pathPrefix + "/auth/login"
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req, "/auth/login")
 	if err != nil {
 		return err
 	}
@@ -157,6 +286,9 @@ func findToken(v interface{}) (string, bool) {
 
 // ensureToken makes sure the client has a token, logging in if necessary.
 func (c *Client) ensureToken(ctx context.Context) error {
+	if c.apiKey != "" {
+		return nil
+	}
 	c.mu.RLock()
 	t := c.token
 	c.mu.RUnlock()
@@ -166,18 +298,76 @@ func (c *Client) ensureToken(ctx context.Context) error {
 	return c.Login(ctx)
 }
 
+// send sends req, logging in again and retrying once if the token expired.
+func (c *Client) send(ctx context.Context, req *http.Request, endpoint string) (*http.Response, error) {
+	resp, err := c.do(req, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// If unauthorized, try to refresh token once. API keys cannot be refreshed.
+	if resp.StatusCode == http.StatusUnauthorized && c.apiKey == "" {
+		resp.Body.Close()
+		if err := c.login(ctx, true); err != nil {
+			return nil, err
+		}
+		c.mu.RLock()
+		token := c.token
+		c.mu.RUnlock()
+		req.Header.Set("Authorization", "Bearer "+token)
+		return c.do(req, endpoint)
+	}
+	return resp, nil
+}
+
+// do sends req and reports it to the observer under endpoint. Requests are
+// rejected with ErrCircuitOpen while the circuit breaker is open.
+func (c *Client) do(req *http.Request, endpoint string) (*http.Response, error) {
+	probe, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.limiter.wait(req.Context()); err != nil {
+		c.breaker.done(req.Context(), probe, nil, err)
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	c.breaker.done(req.Context(), probe, resp, err)
+	if c.observer != nil {
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+		}
+		c.observer.ObserveRequest(endpoint, req.Method, status, time.Since(start))
+	}
+	return resp, err
+}
+
+// endpointOf templates an API path for use as a metric label by replacing
+// website and team IDs with ":id" (e.g. "/websites/abc/stats" => "/websites/:id/stats").
+func endpointOf(path string) string {
+	segs := strings.Split(path, "/")
+	for i := 1; i < len(segs); i++ {
+		if segs[i] != "" && (segs[i-1] == "websites" || segs[i-1] == "teams") {
+			segs[i] = ":id"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
 // doRequest is a helper that performs authenticated requests to the Umami API.
+// path is relative to the API root (e.g. "/websites").
 // If result is non-nil the response body is decoded as JSON into result.
 func (c *Client) doRequest(ctx context.Context, method, path string, query map[string]string, body interface{}, result interface{}) error {
 	if err := c.ensureToken(ctx); err != nil {
 		return err
 	}
 
-	u := c.baseURL
 	if !strings.HasPrefix(path, "/") {
-		u += "/"
+		path = "/" + path
 	}
-	u = strings.TrimRight(u, "/") + path
+	u := c.baseURL + c.pathPrefix + path
 
 	if len(query) > 0 {
 		vals := url.Values{}
@@ -204,38 +394,40 @@ func (c *Client) doRequest(ctx context.Context, method, path string, query map[s
 		req.Header.Set("Content-Type", "application/json")
 	}
 
-	c.mu.RLock()
-	token := c.token
-	c.mu.RUnlock()
-	if token != "" {
-		req.Header.Set("Authorization", "Bearer "+token)
-	}
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return err
+	if c.apiKey != "" {
+		req.Header.Set("x-umami-api-key", c.apiKey)
+	} else {
+		c.mu.RLock()
+		token := c.token
+		c.mu.RUnlock()
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
 	}
 
-	// If unauthorized, try to refresh token once.
-	if resp.StatusCode == http.StatusUnauthorized {
-		resp.Body.Close()
-		if err := c.Login(ctx); err != nil {
-			return err
+	endpoint := endpointOf(path)
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		resp, err = c.send(ctx, req, endpoint)
+		wait, retry := c.retryAfter(req, attempt, resp, err)
+		if !retry {
+			break
 		}
-		c.mu.RLock()
-		token = c.token
-		c.mu.RUnlock()
-		req.Header.Set("Authorization", "Bearer "+token)
-		resp, err = c.httpClient.Do(req)
-		if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if err := sleep(ctx, wait); err != nil {
 			return err
 		}
 	}
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
 		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("request failed: %s %s status=%d body=%s", method, u, resp.StatusCode, string(b))
+		return &APIError{Method: method, URL: u, StatusCode: resp.StatusCode, Body: string(b)}
 	}
 
 	if result != nil {
@@ -247,61 +439,191 @@ func (c *Client) doRequest(ctx context.Context, method, path string, query map[s
 	return nil
 }
 
-// GetWebsites returns all tracked websites (up to a large pageSize).
+// getPaged walks every page of a paginated list endpoint and returns all items.
+// It stops once the reported count is reached, so a server returning fewer
+// items per page than requested is still fully walked. Only responses without
+// a count stop at the first short page.
+func getPaged[T any](ctx context.Context, c *Client, path string) ([]T, error) {
+	var all []T
+	for page := 1; page <= maxPages; page++ {
+		var resp struct {
+			Data  []T  `json:"data"`
+			Count *int `json:"count"`
+		}
+		q := map[string]string{
+			"page":     strconv.Itoa(page),
+			"pageSize": strconv.Itoa(pageSize),
+		}
+		if err := c.doRequest(ctx, http.MethodGet, path, q, nil, &resp); err != nil {
+			return nil, err
+		}
+		all = append(all, resp.Data...)
+		if resp.Count == nil {
+			if len(resp.Data) < pageSize {
+				return all, nil
+			}
+			continue
+		}
+		if len(all) >= *resp.Count {
+			return all, nil
+		}
+		if len(resp.Data) == 0 {
+			return nil, fmt.Errorf("list %s: page %d is empty after %d of %d items", path, page, len(all), *resp.Count)
+		}
+	}
+	return nil, fmt.Errorf("list %s: more than %d pages", path, maxPages)
+}
+
+// GetWebsites returns all websites visible to the authenticated user: the ones it
+// owns and the ones owned by its teams. Every page of each list is fetched and
+// websites appearing in several lists are returned once.
 func (c *Client) GetWebsites(ctx context.Context) ([]Website, error) {
-	var resp struct {
-		Data []Website `json:"data"`
+	websites, err := getPaged[Website](ctx, c, "/websites")
+	if err != nil {
+		return nil, err
+	}
+
+	teams, err := c.GetTeams(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range teams {
+		tw, err := c.GetTeamWebsites(ctx, t.ID)
+		if err != nil {
+			return nil, err
+		}
+		websites = append(websites, tw...)
 	}
-	q := map[string]string{"pageSize": strconv.Itoa(1000)}
-	if err := c.doRequest(ctx, http.MethodGet, "/api/websites", q, nil, &resp); err != nil {
+
+	seen := make(map[string]struct{}, len(websites))
+	out := websites[:0]
+	for _, w := range websites {
+		if _, ok := seen[w.ID]; ok {
+			continue
+		}
+		seen[w.ID] = struct{}{}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+// GetTeams returns the teams the authenticated user belongs to.
+// Umami versions without team support answer 404, which yields no teams.
+func (c *Client) GetTeams(ctx context.Context) ([]Team, error) {
+	teams, err := getPaged[Team](ctx, c, "/teams")
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return teams, err
+}
+
+// GetTeamWebsites returns every website owned by the given team.
+func (c *Client) GetTeamWebsites(ctx context.Context, teamID string) ([]Website, error) {
+	websites, err := getPaged[Website](ctx, c, "/teams/"+url.PathEscape(teamID)+"/websites")
+	if err != nil {
 		return nil, err
 	}
-	return resp.Data, nil
+	for i := range websites {
+		if websites[i].TeamID == "" {
+			websites[i].TeamID = teamID
+		}
+	}
+	return websites, nil
 }
 
-// GetWebsiteStats fetches summarized stats for the website.
-// It provides a default date range (last 30 days) as Umami expects numeric startAt/endAt.
-func (c *Client) GetWebsiteStats(ctx context.Context, id string) (*WebsiteStats, error) {
+// GetWebsiteStats fetches summarized stats for the website between start and end.
+func (c *Client) GetWebsiteStats(ctx context.Context, id string, start, end time.Time) (*WebsiteStats, error) {
 	var ws WebsiteStats
-	now := time.Now()
-	start := now.Add(-30 * 24 * time.Hour)
-	q := map[string]string{
-		"startAt": strconv.FormatInt(start.UnixMilli(), 10),
-		"endAt":   strconv.FormatInt(now.UnixMilli(), 10),
-	}
-	if err := c.doRequest(ctx, http.MethodGet, "/api/websites/"+id+"/stats", q, nil, &ws); err != nil {
+	q := dateRange(start, end)
+	if err := c.doRequest(ctx, http.MethodGet, "/websites/"+url.PathEscape(id)+"/stats", q, nil, &ws); err != nil {
 		return nil, err
 	}
 	return &ws, nil
 }
 
+// GetWebsite returns a single website by ID.
+func (c *Client) GetWebsite(ctx context.Context, id string) (*Website, error) {
+	var w Website
+	if err := c.doRequest(ctx, http.MethodGet, "/websites/"+url.PathEscape(id), nil, nil, &w); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
 // GetWebsiteActive returns number of active visitors for the website.
 func (c *Client) GetWebsiteActive(ctx context.Context, id string) (float64, error) {
 	var resp struct {
 		Visitors float64 `json:"visitors"`
 	}
-	if err := c.doRequest(ctx, http.MethodGet, "/api/websites/"+id+"/active", nil, nil, &resp); err != nil {
+	if err := c.doRequest(ctx, http.MethodGet, "/websites/"+url.PathEscape(id)+"/active", nil, nil, &resp); err != nil {
 		return 0, err
 	}
 	return resp.Visitors, nil
 }
 
-// GetWebsiteMetrics fetches metric entries for the given type (e.g. url, referrer).
-// Adds a default date range (last 30 days) to conform with Umami API expectations.
-func (c *Client) GetWebsiteMetrics(ctx context.Context, id, typ string, limit int) ([]MetricEntry, error) {
-	now := time.Now()
-	start := now.Add(-30 * 24 * time.Hour)
-	q := map[string]string{
-		"type":    typ,
-		"startAt": strconv.FormatInt(start.UnixMilli(), 10),
-		"endAt":   strconv.FormatInt(now.UnixMilli(), 10),
-	}
+// GetWebsiteMetrics fetches metric entries for the given type (e.g. url, referrer)
+// between start and end.
+func (c *Client) GetWebsiteMetrics(ctx context.Context, id, typ string, start, end time.Time, limit int) ([]MetricEntry, error) {
+	q := dateRange(start, end)
+	q["type"] = typ
 	if limit > 0 {
 		q["limit"] = strconv.Itoa(limit)
 	}
 	var entries []MetricEntry
-	if err := c.doRequest(ctx, http.MethodGet, "/api/websites/"+id+"/metrics", q, nil, &entries); err != nil {
+	if err := c.doRequest(ctx, http.MethodGet, "/websites/"+url.PathEscape(id)+"/metrics", q, nil, &entries); err != nil {
 		return nil, err
 	}
 	return entries, nil
 }
+
+// GetWebsitePageviews returns pageviews and sessions between start and end,
+// bucketed by unit (minute, hour, day, month or year) in the timezone tz.
+func (c *Client) GetWebsitePageviews(ctx context.Context, id string, start, end time.Time, unit, tz string) (*PageviewSeries, error) {
+	q := dateRange(start, end)
+	q["unit"] = unit
+	if tz != "" {
+		q["timezone"] = tz
+	}
+	var ps PageviewSeries
+	if err := c.doRequest(ctx, http.MethodGet, "/websites/"+url.PathEscape(id)+"/pageviews", q, nil, &ps); err != nil {
+		return nil, err
+	}
+	return &ps, nil
+}
+
+// GetEventDataEvents returns the property keys recorded for custom events between
+// start and end. If event is not empty only that event is returned.
+func (c *Client) GetEventDataEvents(ctx context.Context, id, event string, start, end time.Time) ([]EventDataEvent, error) {
+	q := dateRange(start, end)
+	if event != "" {
+		q["event"] = event
+	}
+	var events []EventDataEvent
+	if err := c.doRequest(ctx, http.MethodGet, "/websites/"+url.PathEscape(id)+"/event-data/events", q, nil, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// GetEventDataValues returns the values of one property of a custom event
+// between start and end, with the number of times each value was recorded.
+func (c *Client) GetEventDataValues(ctx context.Context, id, event, property string, start, end time.Time) ([]EventDataValue, error) {
+	q := dateRange(start, end)
+	q["eventName"] = event
+	q["propertyName"] = property
+	var values []EventDataValue
+	if err := c.doRequest(ctx, http.MethodGet, "/websites/"+url.PathEscape(id)+"/event-data/values", q, nil, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// dateRange returns the startAt/endAt query parameters, as Umami expects
+// numeric millisecond timestamps.
+func dateRange(start, end time.Time) map[string]string {
+	return map[string]string{
+		"startAt": strconv.FormatInt(start.UnixMilli(), 10),
+		"endAt":   strconv.FormatInt(end.UnixMilli(), 10),
+	}
+}
@@ -0,0 +1,169 @@
+package umami
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures retries of failed GET requests. Requests are retried on
+// network errors, except ErrCircuitOpen, and on 429, 500, 502, 503 and 504
+// responses, waiting an exponentially growing, jittered delay between
+// MinBackoff and MaxBackoff, or the delay given by the Retry-After header of
+// 429 and 503 responses. A retry is never attempted if its delay exceeds
+// MaxBackoff, as a long Retry-After would stall the whole update cycle, or
+// would outlast the context deadline.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt; 0 disables retries.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// SetRetryPolicy sets the retry policy of the client. It must be called before
+// the client is used.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+}
+
+// SetRateLimit limits the client to rps requests per second on average with
+// bursts of up to burst requests, retries and logins included. rps <= 0
+// removes the limit. It must be called before the client is used.
+func (c *Client) SetRateLimit(rps float64, burst int) {
+	if rps <= 0 {
+		c.limiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	c.limiter = &limiter{rate: rps, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// retryAfter reports whether the request should be retried after attempt
+// (0 for the first one) and how long to wait before doing so.
+func (c *Client) retryAfter(req *http.Request, attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if req.Method != http.MethodGet || attempt >= c.retry.MaxRetries {
+		return 0, false
+	}
+	ctx := req.Context()
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCircuitOpen) {
+			return 0, false
+		}
+	} else {
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			return 0, false
+		}
+	}
+
+	wait := c.backoff(attempt)
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			wait = d
+		}
+	}
+	if c.retry.MaxBackoff > 0 && wait > c.retry.MaxBackoff {
+		return 0, false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+		return 0, false
+	}
+	return wait, true
+}
+
+// backoff returns the jittered delay before retry attempt+1: a random duration
+// between half and all of MinBackoff * 2^attempt, capped at MaxBackoff.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.retry.MinBackoff
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	for i := 0; i < attempt && (c.retry.MaxBackoff <= 0 || d < c.retry.MaxBackoff); i++ {
+		d *= 2
+	}
+	if c.retry.MaxBackoff > 0 && d > c.retry.MaxBackoff {
+		d = c.retry.MaxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// parseRetryAfter parses a Retry-After header holding either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// limiter is a token bucket refilled at rate tokens per second up to burst.
+// A nil limiter never waits.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// wait takes a token, waiting until one is available or ctx is done.
+func (l *limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// take the token now, possibly going negative: later callers queue behind
+	l.tokens--
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if d == 0 {
+		return nil
+	}
+	if err := sleep(ctx, d); err != nil {
+		// give the token back so a canceled request does not delay others
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/config"
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+)
+
+// bucketLayouts are the formats in which Umami returns time-series bucket starts.
+var bucketLayouts = []string{"2006-01-02 15:04:05", time.RFC3339, "2006-01-02"}
+
+// Backfill walks the range [from, to) in steps of step, ignoring a trailing
+// partial step, and passes record one snapshot per step, holding the stats of
+// every website for that step as a window named after it, and one snapshot per
+// complete bucket of each configured bucket unit. Snapshots are passed in
+// chronological order for each series, with the time at which the exporter
+// would have reported them. Requests run sequentially; failed ones are logged
+// and skipped, and reported in the returned error once the whole range has been
+// walked.
+func (u *Updater) Backfill(ctx context.Context, from, to time.Time, step config.Window, record func(*prommetrics.Snapshot, time.Time) error) error {
+	if step.Calendar != "" {
+		return fmt.Errorf("step %q: calendar windows cannot be used as a step", step.Name)
+	}
+
+	websites, err := u.client.GetWebsites(ctx)
+	if err != nil {
+		return fmt.Errorf("list websites: %w", err)
+	}
+
+	if from.Add(step.Duration).After(to) {
+		return fmt.Errorf("range %s to %s is shorter than step %s", from.Format(time.RFC3339), to.Format(time.RFC3339), step.Name)
+	}
+
+	failed := 0
+	for start := from; !start.Add(step.Duration).After(to); start = start.Add(step.Duration) {
+		end := start.Add(step.Duration)
+		u.logger.Printf("backfill: fetching %s to %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+		snap := &prommetrics.Snapshot{}
+		for _, w := range websites {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			settings := u.cfg.ForWebsite(w.ID, w.Domain)
+			if settings.Disabled {
+				continue
+			}
+			ws := prommetrics.WebsiteSnapshot{ID: w.ID, Name: w.Name, Domain: w.Domain, Labels: settings.Labels}
+
+			stats, err := u.client.GetWebsiteStats(ctx, w.ID, start, end)
+			if err != nil {
+				u.logger.Printf("backfill: website %s stats error: %v", w.ID, err)
+				failed++
+			} else if stats != nil {
+				win := prommetrics.WindowSnapshot{Name: step.Name, Stats: &prommetrics.Stats{
+					Pageviews: prommetrics.StatValue(stats.Pageviews),
+					Visitors:  prommetrics.StatValue(stats.Visitors),
+					Visits:    prommetrics.StatValue(stats.Visits),
+					Bounces:   prommetrics.StatValue(stats.Bounces),
+					Totaltime: prommetrics.StatValue(stats.Totaltime),
+				}}
+				win.Engagement = engagement(win.Stats)
+				ws.Windows = append(ws.Windows, win)
+				snap.Websites = append(snap.Websites, ws)
+			}
+
+			for _, unit := range u.cfg.BucketUnits {
+				if err := u.backfillBuckets(ctx, ws, unit, start, end, to, record); err != nil {
+					u.logger.Printf("backfill: website %s pageviews unit %s error: %v", w.ID, unit, err)
+					failed++
+				}
+			}
+		}
+		if err := record(snap, end); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d requests failed, see log", failed)
+	}
+	return nil
+}
+
+// backfillBuckets records the complete buckets of unit starting between start
+// and end, each at its end time. Buckets ending after to are incomplete and skipped.
+func (u *Updater) backfillBuckets(ctx context.Context, w prommetrics.WebsiteSnapshot, unit string, start, end, to time.Time, record func(*prommetrics.Snapshot, time.Time) error) error {
+	ps, err := u.client.GetWebsitePageviews(ctx, w.ID, start, end.Add(-time.Millisecond), unit, u.cfg.Location.String())
+	if err != nil {
+		return err
+	}
+
+	sessions := make(map[string]float64, len(ps.Sessions))
+	for _, e := range ps.Sessions {
+		sessions[e.X] += e.Y
+	}
+	w.Windows = nil
+	for _, e := range ps.Pageviews {
+		bstart, err := u.parseBucket(e.X)
+		if err != nil {
+			return err
+		}
+		bend := bucketEnd(unit, bstart)
+		if bend.After(to) {
+			continue
+		}
+		w.Buckets = []prommetrics.BucketSnapshot{{Unit: unit, Start: bstart, Pageviews: e.Y, Sessions: sessions[e.X]}}
+		if err := record(&prommetrics.Snapshot{Websites: []prommetrics.WebsiteSnapshot{w}}, bend); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBucket parses the start of a time-series bucket in the instance timezone.
+func (u *Updater) parseBucket(s string) (time.Time, error) {
+	for _, layout := range bucketLayouts {
+		if t, err := time.ParseInLocation(layout, s, u.cfg.Location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid bucket time %q", s)
+}
+
+// bucketEnd returns the end of the bucket of unit starting at start.
+func bucketEnd(unit string, start time.Time) time.Time {
+	switch unit {
+	case "minute":
+		return start.Add(time.Minute)
+	case "hour":
+		return start.Add(time.Hour)
+	default: // day
+		return start.AddDate(0, 0, 1)
+	}
+}
@@ -0,0 +1,41 @@
+package updater
+
+import (
+	"sort"
+)
+
+// applyBudget fits the requests of a cycle into the configured request budget.
+// The high-priority requests (active visitors, pageview buckets and stats)
+// cost high requests and are never deferred; the rest of the budget goes to the
+// low-priority ones (metric types and event properties), those not fetched for
+// the most cycles first, then in configuration order. Requests that do not fit
+// are left out of plan and deferred to later cycles.
+func (u *Updater) applyBudget(plan *cyclePlan, high int, low []task) {
+	sort.SliceStable(low, func(a, b int) bool {
+		la, lb := u.lowFetched[low[a].key], u.lowFetched[low[b].key]
+		if la != lb {
+			return la < lb
+		}
+		return low[a].prio < low[b].prio
+	})
+
+	u.cycle++
+	remaining := u.cfg.RequestBudget - high
+	deferred := 0
+	for _, t := range low {
+		if t.cost > remaining {
+			deferred++
+			continue
+		}
+		remaining -= t.cost
+		plan.allowed[t.key] = true
+		u.lowFetched[t.key] = u.cycle
+	}
+
+	if high > u.cfg.RequestBudget {
+		u.logger.Printf("updater: request budget %d is lower than the %d stats and active visitors requests, which are never deferred", u.cfg.RequestBudget, high)
+	}
+	if deferred > 0 {
+		u.logger.Printf("updater: request budget %d reached, deferred %d of %d metric requests to later cycles", u.cfg.RequestBudget, deferred, len(low))
+	}
+}
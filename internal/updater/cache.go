@@ -0,0 +1,235 @@
+package updater
+
+import (
+	"sort"
+	"time"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/config"
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+)
+
+// fetchFailures records which parts of a website fetch failed during a cycle,
+// and which were not fetched because they were not due or did not fit in the
+// request budget.
+type fetchFailures struct {
+	active  bool
+	buckets []string
+	windows map[string]windowFailures
+
+	deferredActive  bool
+	deferredBuckets []string
+
+	// err is the last error returned by a failed request.
+	err error
+}
+
+func (f fetchFailures) any() bool {
+	if f.active || len(f.buckets) > 0 {
+		return true
+	}
+	for _, wf := range f.windows {
+		if wf.any() {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns the number of failed requests, counting a failed wildcard
+// event property selector once.
+func (f fetchFailures) count() int {
+	n := len(f.buckets)
+	if f.active {
+		n++
+	}
+	for _, wf := range f.windows {
+		n += len(wf.types) + len(wf.events)
+		if wf.stats {
+			n++
+		}
+	}
+	return n
+}
+
+// windowFailures records which requests of one time window failed, and which
+// were deferred to a later cycle.
+type windowFailures struct {
+	stats  bool
+	types  []string
+	events []config.EventProperty
+
+	deferredStats  bool
+	deferredTypes  []string
+	deferredEvents []config.EventProperty
+
+	err error
+}
+
+func (f windowFailures) any() bool {
+	return f.stats || len(f.types) > 0 || len(f.events) > 0
+}
+
+func (f windowFailures) deferred() bool {
+	return f.deferredStats || len(f.deferredTypes) > 0 || len(f.deferredEvents) > 0
+}
+
+// applyCache merges ws with the last-known-good values of the same website.
+// Deferred requests keep their cached values and do not make the website stale.
+// A fetch without failures refreshes the cache; otherwise the failed parts are
+// filled from the cache as long as the last success is within the stale window,
+// and the website is flagged as stale.
+func (u *Updater) applyCache(ws *prommetrics.WebsiteSnapshot, ff fetchFailures, now time.Time) {
+	prev, cached := u.cache[ws.ID]
+	if cached {
+		if ff.deferredActive {
+			ws.Active = prev.Active
+		}
+		ws.Buckets = append(ws.Buckets, prevBuckets(prev.Buckets, ff.deferredBuckets)...)
+		for i := range ws.Windows {
+			wf := ff.windows[ws.Windows[i].Name]
+			pw := findWindow(prev.Windows, ws.Windows[i].Name)
+			if pw == nil {
+				continue
+			}
+			if wf.deferredStats {
+				ws.Windows[i].Stats = pw.Stats
+				ws.Windows[i].Engagement = pw.Engagement
+			}
+			fillWindow(&ws.Windows[i], pw, wf.deferredTypes, wf.deferredEvents)
+		}
+	}
+	if !ff.any() {
+		ws.LastSuccess = now
+		u.cache[ws.ID] = *ws
+		return
+	}
+
+	ws.Stale = true
+	if !cached {
+		return
+	}
+	ws.LastSuccess = prev.LastSuccess
+	if now.Sub(prev.LastSuccess) > u.staleWindow {
+		u.logger.Printf("updater: website %s data older than %s, dropping cached values", ws.ID, u.staleWindow)
+		u.cache[ws.ID] = *ws
+		u.sched.forget(ws.ID)
+		return
+	}
+
+	if ff.active {
+		ws.Active = prev.Active
+	}
+	ws.Buckets = append(ws.Buckets, prevBuckets(prev.Buckets, ff.buckets)...)
+	for i := range ws.Windows {
+		win := &ws.Windows[i]
+		wf, failed := ff.windows[win.Name]
+		if !failed {
+			continue
+		}
+		pw := findWindow(prev.Windows, win.Name)
+		if pw == nil {
+			continue
+		}
+		if wf.stats {
+			win.Stats = pw.Stats
+			win.Engagement = pw.Engagement
+		}
+		fillWindow(win, pw, wf.types, wf.events)
+	}
+	u.cache[ws.ID] = *ws
+}
+
+// prevBuckets returns the buckets of the given units.
+func prevBuckets(buckets []prommetrics.BucketSnapshot, units []string) []prommetrics.BucketSnapshot {
+	var out []prommetrics.BucketSnapshot
+	for _, unit := range units {
+		for _, b := range buckets {
+			if b.Unit == unit {
+				out = append(out, b)
+			}
+		}
+	}
+	return out
+}
+
+// findWindow returns the window named name, or nil.
+func findWindow(windows []prommetrics.WindowSnapshot, name string) *prommetrics.WindowSnapshot {
+	for i := range windows {
+		if windows[i].Name == name {
+			return &windows[i]
+		}
+	}
+	return nil
+}
+
+// fillWindow copies into win the values of the given metric types and event
+// property selectors from the previous snapshot pw of the same window. Event
+// properties already in win, fetched through an overlapping selector, are kept
+// and each cached pair is copied once, so no series is exported twice.
+func fillWindow(win, pw *prommetrics.WindowSnapshot, types []string, events []config.EventProperty) {
+	for _, typ := range types {
+		for _, mv := range pw.Metrics {
+			if sourceType(mv.Type) == typ {
+				win.Metrics = append(win.Metrics, mv)
+			}
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+	present := make(map[config.EventProperty]bool, len(win.EventProperties))
+	for _, pv := range win.EventProperties {
+		present[config.EventProperty{Event: pv.Event, Property: pv.Property}] = true
+	}
+	for _, pv := range pw.EventProperties {
+		if present[config.EventProperty{Event: pv.Event, Property: pv.Property}] {
+			continue
+		}
+		for _, ep := range events {
+			if (ep.Event == "*" || pv.Event == ep.Event) && (ep.Property == "*" || pv.Property == ep.Property) {
+				win.EventProperties = append(win.EventProperties, pv)
+				break
+			}
+		}
+	}
+}
+
+// publishCache publishes the cached websites, flagged as stale, when the
+// website list cannot be fetched, e.g. during an Umami outage. Websites whose
+// last success is older than the stale window are left out.
+func (u *Updater) publishCache(now time.Time) {
+	snap := &prommetrics.Snapshot{}
+	for _, ws := range u.cache {
+		if now.Sub(ws.LastSuccess) > u.staleWindow {
+			continue
+		}
+		ws.Stale = true
+		snap.Websites = append(snap.Websites, ws)
+	}
+	sort.Slice(snap.Websites, func(i, j int) bool { return snap.Websites[i].ID < snap.Websites[j].ID })
+	u.foldSnapshot(snap)
+	u.setWebsiteStatus(len(snap.Websites), len(snap.Websites), nil)
+	if u.metrics != nil {
+		u.metrics.Publish(u.cfg.Name, snap)
+	}
+}
+
+// pruneCache forgets websites that are no longer part of the snapshot, along
+// with their schedule.
+func (u *Updater) pruneCache(snap *prommetrics.Snapshot) {
+	seen := make(map[string]struct{}, len(snap.Websites))
+	for _, w := range snap.Websites {
+		seen[w.ID] = struct{}{}
+	}
+	for id := range u.cache {
+		if _, ok := seen[id]; !ok {
+			delete(u.cache, id)
+		}
+	}
+	for key := range u.lowFetched {
+		if _, ok := seen[websiteOfTask(key)]; !ok {
+			delete(u.lowFetched, key)
+		}
+	}
+	u.sched.prune(seen)
+}
@@ -0,0 +1,102 @@
+package updater
+
+import (
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/config"
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestApplyCacheOverlappingEventSelectors checks that values fetched through
+// one selector are not copied again from the cache when an overlapping
+// selector fails or is deferred, which would export duplicate series.
+func TestApplyCacheOverlappingEventSelectors(t *testing.T) {
+	now := time.Now()
+	cached := prommetrics.WebsiteSnapshot{
+		ID:          "w1",
+		LastSuccess: now.Add(-time.Minute),
+		Windows: []prommetrics.WindowSnapshot{{
+			Name: "30d",
+			EventProperties: []prommetrics.EventPropertyValue{
+				{Event: "signup", Property: "plan", Value: "pro", Count: 3},
+				{Event: "signup", Property: "plan", Value: "free", Count: 5},
+				{Event: "click", Property: "button", Value: "cta", Count: 7},
+			},
+		}},
+	}
+
+	tests := []struct {
+		name string
+		wf   windowFailures
+	}{
+		{
+			name: "failed",
+			wf: windowFailures{
+				events: []config.EventProperty{{Event: "*", Property: "*"}},
+				err:    errors.New("boom"),
+			},
+		},
+		{
+			name: "deferred",
+			wf: windowFailures{
+				deferredEvents: []config.EventProperty{{Event: "*", Property: "*"}},
+			},
+		},
+		{
+			name: "failed and deferred",
+			wf: windowFailures{
+				events:         []config.EventProperty{{Event: "click", Property: "*"}},
+				deferredEvents: []config.EventProperty{{Event: "*", Property: "*"}},
+				err:            errors.New("boom"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &Updater{
+				cfg:         &config.Instance{Name: "default"},
+				staleWindow: time.Hour,
+				logger:      log.New(io.Discard, "", 0),
+				cache:       map[string]prommetrics.WebsiteSnapshot{"w1": cached},
+			}
+			// signup:plan was fetched during this cycle
+			ws := prommetrics.WebsiteSnapshot{
+				ID: "w1",
+				Windows: []prommetrics.WindowSnapshot{{
+					Name: "30d",
+					EventProperties: []prommetrics.EventPropertyValue{
+						{Event: "signup", Property: "plan", Value: "pro", Count: 4},
+					},
+				}},
+			}
+			ff := fetchFailures{windows: map[string]windowFailures{"30d": tt.wf}}
+			u.applyCache(&ws, ff, now)
+
+			got := ws.Windows[0].EventProperties
+			want := []prommetrics.EventPropertyValue{
+				{Event: "signup", Property: "plan", Value: "pro", Count: 4},
+				{Event: "click", Property: "button", Value: "cta", Count: 7},
+			}
+			if len(got) != len(want) {
+				t.Fatalf("event properties = %v, want %v", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("event properties = %v, want %v", got, want)
+				}
+			}
+
+			reg := prometheus.NewRegistry()
+			m := prommetrics.NewWithRegisterer(reg, nil)
+			m.Publish(u.cfg.Name, &prommetrics.Snapshot{Websites: []prommetrics.WebsiteSnapshot{ws}})
+			if _, err := reg.Gather(); err != nil {
+				t.Fatalf("gather: %v", err)
+			}
+		})
+	}
+}
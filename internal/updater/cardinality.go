@@ -0,0 +1,231 @@
+package updater
+
+import (
+	"sort"
+
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+)
+
+// OtherValue is the value label of the bucket aggregating folded values.
+const OtherValue = "__other__"
+
+// ReferrerDomainType is the type label of referrer entries grouped by domain.
+const ReferrerDomainType = "referrer_domain"
+
+// sourceType returns the Umami metric type a value of type typ was built from.
+func sourceType(typ string) string {
+	if typ == ReferrerDomainType {
+		return "referrer"
+	}
+	return typ
+}
+
+// valueKind describes how the cardinality limits handle one kind of snapshot
+// value. Values of the same group share an OtherValue bucket.
+type valueKind[T any] struct {
+	group   func(T) string
+	count   func(T) float64
+	isOther func(T) bool
+	// other returns the OtherValue bucket of the group of v, holding sum.
+	other func(v T, sum float64) T
+	// add returns v with sum added to its count.
+	add func(v T, sum float64) T
+}
+
+var metricValueKind = valueKind[prommetrics.MetricValue]{
+	group:   func(v prommetrics.MetricValue) string { return v.Type },
+	count:   func(v prommetrics.MetricValue) float64 { return v.Count },
+	isOther: func(v prommetrics.MetricValue) bool { return v.Value == OtherValue },
+	other: func(v prommetrics.MetricValue, sum float64) prommetrics.MetricValue {
+		return prommetrics.MetricValue{Type: v.Type, Value: OtherValue, Count: sum}
+	},
+	add: func(v prommetrics.MetricValue, sum float64) prommetrics.MetricValue {
+		v.Count += sum
+		return v
+	},
+}
+
+var eventPropertyKind = valueKind[prommetrics.EventPropertyValue]{
+	group:   func(v prommetrics.EventPropertyValue) string { return v.Event + "\x00" + v.Property },
+	count:   func(v prommetrics.EventPropertyValue) float64 { return v.Count },
+	isOther: func(v prommetrics.EventPropertyValue) bool { return v.Value == OtherValue },
+	other: func(v prommetrics.EventPropertyValue, sum float64) prommetrics.EventPropertyValue {
+		return prommetrics.EventPropertyValue{Event: v.Event, Property: v.Property, Value: OtherValue, Count: sum}
+	},
+	add: func(v prommetrics.EventPropertyValue, sum float64) prommetrics.EventPropertyValue {
+		v.Count += sum
+		return v
+	},
+}
+
+// foldTopN keeps, for each group, the n values with the highest counts and sums
+// the remaining ones into an OtherValue entry. It returns the resulting values
+// and the number of values folded. n <= 0 disables folding.
+func foldTopN[T any](values []T, n int, k valueKind[T]) ([]T, int) {
+	if n <= 0 {
+		return values, 0
+	}
+
+	var order []string
+	byGroup := make(map[string][]T)
+	for _, v := range values {
+		g := k.group(v)
+		if _, ok := byGroup[g]; !ok {
+			order = append(order, g)
+		}
+		byGroup[g] = append(byGroup[g], v)
+	}
+
+	out := make([]T, 0, len(values))
+	folded := 0
+	for _, g := range order {
+		vals := byGroup[g]
+		if len(vals) <= n {
+			out = append(out, vals...)
+			continue
+		}
+		sort.SliceStable(vals, func(i, j int) bool { return k.count(vals[i]) > k.count(vals[j]) })
+		sum := 0.0
+		for _, v := range vals[n:] {
+			sum += k.count(v)
+		}
+		folded += len(vals) - n
+		out = append(out, vals[:n]...)
+		out = append(out, k.other(vals[0], sum))
+	}
+	return out, folded
+}
+
+// budgetList is a slice of snapshot values subject to the series budget.
+type budgetList interface {
+	len() int
+	count(i int) float64
+	group(i int) string
+	isOther(i int) bool
+	// fold removes the dropped values and adds their counts to the OtherValue
+	// bucket of their group, creating missing buckets.
+	fold(dropped map[int]bool)
+}
+
+// sliceList adapts a slice of values of kind k to budgetList.
+type sliceList[T any] struct {
+	values *[]T
+	k      valueKind[T]
+}
+
+func (s sliceList[T]) len() int            { return len(*s.values) }
+func (s sliceList[T]) count(i int) float64 { return s.k.count((*s.values)[i]) }
+func (s sliceList[T]) group(i int) string  { return s.k.group((*s.values)[i]) }
+func (s sliceList[T]) isOther(i int) bool  { return s.k.isOther((*s.values)[i]) }
+
+func (s sliceList[T]) fold(dropped map[int]bool) {
+	var order []string
+	sums := make(map[string]float64)
+	samples := make(map[string]T)
+	for i, v := range *s.values {
+		if !dropped[i] {
+			continue
+		}
+		g := s.k.group(v)
+		if _, ok := samples[g]; !ok {
+			samples[g] = v
+			order = append(order, g)
+		}
+		sums[g] += s.k.count(v)
+	}
+
+	out := make([]T, 0, len(*s.values))
+	for i, v := range *s.values {
+		if dropped[i] {
+			continue
+		}
+		if g := s.k.group(v); s.k.isOther(v) {
+			if sum, ok := sums[g]; ok {
+				v = s.k.add(v, sum)
+				delete(sums, g)
+			}
+		}
+		out = append(out, v)
+	}
+	for _, g := range order {
+		if sum, ok := sums[g]; ok {
+			out = append(out, s.k.other(samples[g], sum))
+		}
+	}
+	*s.values = out
+}
+
+// applySeriesBudget folds the metric and event property values with the lowest
+// counts across the whole snapshot into the OtherValue bucket of their website,
+// window and group until the number of value series fits in budget. It must run
+// before the snapshot is published and returns the number of values folded.
+// The windows of snap are copied first as they are shared with the website
+// cache, which must keep the values as fetched. budget <= 0 disables the limit.
+func applySeriesBudget(snap *prommetrics.Snapshot, budget int) int {
+	if budget <= 0 {
+		return 0
+	}
+
+	var lists []budgetList
+	for i := range snap.Websites {
+		snap.Websites[i].Windows = append([]prommetrics.WindowSnapshot(nil), snap.Websites[i].Windows...)
+		for j := range snap.Websites[i].Windows {
+			win := &snap.Websites[i].Windows[j]
+			lists = append(lists,
+				sliceList[prommetrics.MetricValue]{&win.Metrics, metricValueKind},
+				sliceList[prommetrics.EventPropertyValue]{&win.EventProperties, eventPropertyKind})
+		}
+	}
+
+	type ref struct {
+		list int
+		idx  int
+	}
+	var (
+		total    int
+		refs     []ref
+		hasOther = make([]map[string]bool, len(lists))
+	)
+	for li, l := range lists {
+		hasOther[li] = make(map[string]bool)
+		for i := 0; i < l.len(); i++ {
+			total++
+			if l.isOther(i) {
+				hasOther[li][l.group(i)] = true
+				continue
+			}
+			refs = append(refs, ref{li, i})
+		}
+	}
+	if total <= budget {
+		return 0
+	}
+
+	sort.SliceStable(refs, func(a, b int) bool {
+		return lists[refs[a].list].count(refs[a].idx) < lists[refs[b].list].count(refs[b].idx)
+	})
+
+	folded := 0
+	dropped := make(map[int]map[int]bool)
+	for _, r := range refs {
+		if total <= budget {
+			break
+		}
+		if dropped[r.list] == nil {
+			dropped[r.list] = make(map[int]bool)
+		}
+		dropped[r.list][r.idx] = true
+		folded++
+		// folding into an existing bucket removes a series, creating the bucket does not
+		if g := lists[r.list].group(r.idx); hasOther[r.list][g] {
+			total--
+		} else {
+			hasOther[r.list][g] = true
+		}
+	}
+
+	for li, idx := range dropped {
+		lists[li].fold(idx)
+	}
+	return folded
+}
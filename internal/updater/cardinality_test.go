@@ -0,0 +1,39 @@
+package updater
+
+import (
+	"testing"
+
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+)
+
+// TestApplySeriesBudgetKeepsCache checks that folding a snapshot leaves the
+// website it was built from, as held by the cache, unchanged.
+func TestApplySeriesBudgetKeepsCache(t *testing.T) {
+	cached := prommetrics.WebsiteSnapshot{
+		ID: "w1",
+		Windows: []prommetrics.WindowSnapshot{{
+			Name: "30d",
+			Metrics: []prommetrics.MetricValue{
+				{Type: "url", Value: "/a", Count: 3},
+				{Type: "url", Value: "/b", Count: 2},
+				{Type: "url", Value: "/c", Count: 1},
+			},
+		}},
+	}
+	snap := &prommetrics.Snapshot{Websites: []prommetrics.WebsiteSnapshot{cached}}
+
+	if folded := applySeriesBudget(snap, 2); folded != 2 {
+		t.Fatalf("folded = %d, want 2", folded)
+	}
+	if got := len(snap.Websites[0].Windows[0].Metrics); got != 2 {
+		t.Fatalf("snapshot has %d values, want 2", got)
+	}
+	for _, mv := range cached.Windows[0].Metrics {
+		if mv.Value == OtherValue {
+			t.Fatalf("cached values were folded: %v", cached.Windows[0].Metrics)
+		}
+	}
+	if got := len(cached.Windows[0].Metrics); got != 3 {
+		t.Fatalf("cache has %d values, want 3", got)
+	}
+}
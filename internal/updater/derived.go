@@ -0,0 +1,20 @@
+package updater
+
+import (
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+)
+
+// engagement derives bounce rate, average visit duration and pages per visit from
+// one set of stats, so that the ratios are consistent with the exported counts.
+// It returns nil when there were no visits in the window.
+func engagement(st *prommetrics.Stats) *prommetrics.Engagement {
+	if st == nil || st.Visits.Value <= 0 {
+		return nil
+	}
+	visits := st.Visits.Value
+	return &prommetrics.Engagement{
+		BounceRate:              st.Bounces.Value / visits,
+		AvgVisitDurationSeconds: st.Totaltime.Value / visits,
+		PagesPerVisit:           st.Pageviews.Value / visits,
+	}
+}
@@ -0,0 +1,103 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+)
+
+// cacheFileVersion is the version of the cache file format written by saveCache.
+const cacheFileVersion = 1
+
+// cacheFile is the on-disk form of the website cache of an instance.
+type cacheFile struct {
+	Version   int
+	Instance  string
+	LastFetch time.Time
+	Websites  []prommetrics.WebsiteSnapshot
+}
+
+// saveCache writes the cache of the websites of snap to the configured cache
+// file. The file is replaced atomically so a crash never leaves a truncated one.
+func (u *Updater) saveCache(snap *prommetrics.Snapshot, now time.Time) error {
+	path := u.cfg.CacheFile()
+	if path == "" {
+		return nil
+	}
+
+	cf := cacheFile{Version: cacheFileVersion, Instance: u.cfg.Name, LastFetch: now}
+	for _, w := range snap.Websites {
+		if ws, ok := u.cache[w.ID]; ok {
+			cf.Websites = append(cf.Websites, ws)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := json.NewEncoder(tmp).Encode(cf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restore loads the cache file written by a previous run and publishes its
+// websites, flagged as stale, until the first cycle completes. Websites whose
+// last success is older than the stale window are left out. A missing cache
+// file is not an error.
+func (u *Updater) Restore() error {
+	path := u.cfg.CacheFile()
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var cf cacheFile
+	if err := json.NewDecoder(f).Decode(&cf); err != nil {
+		return fmt.Errorf("cache file %s: %w", path, err)
+	}
+	if cf.Version != cacheFileVersion {
+		return fmt.Errorf("cache file %s: unsupported version %d", path, cf.Version)
+	}
+
+	now := time.Now()
+	snap := &prommetrics.Snapshot{}
+	for _, ws := range cf.Websites {
+		if now.Sub(ws.LastSuccess) > u.staleWindow {
+			continue
+		}
+		ws.Stale = true
+		u.cache[ws.ID] = ws
+		snap.Websites = append(snap.Websites, ws)
+	}
+	u.foldSnapshot(snap)
+
+	if u.metrics != nil {
+		u.metrics.Publish(u.cfg.Name, snap)
+		u.metrics.LastFetch.WithLabelValues(u.cfg.Name).Set(float64(cf.LastFetch.Unix()))
+	}
+	atomic.StoreInt64(&u.lastFetchUnix, cf.LastFetch.Unix())
+	u.logger.Printf("updater: restored %d of %d websites from %s, saved at %s", len(snap.Websites), len(cf.Websites), path, cf.LastFetch.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,63 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/config"
+	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
+)
+
+// probeEntry is a probe result cached until expires.
+type probeEntry struct {
+	ws      prommetrics.WebsiteSnapshot
+	expires time.Time
+}
+
+// Probe fetches a single website outside of the update loop, for window or,
+// when window is nil, for every window configured for the website. Fully
+// successful results are cached per website and window for the configured
+// probe TTL. When some requests fail, Probe returns the partial snapshot along
+// with an error.
+func (u *Updater) Probe(ctx context.Context, websiteID string, window *config.Window) (prommetrics.WebsiteSnapshot, error) {
+	key := websiteID
+	if window != nil {
+		key += "\x00" + window.Name
+	}
+
+	now := time.Now()
+	u.probeMu.Lock()
+	for k, e := range u.probeCache {
+		if now.After(e.expires) {
+			delete(u.probeCache, k)
+		}
+	}
+	e, ok := u.probeCache[key]
+	u.probeMu.Unlock()
+	if ok {
+		return e.ws, nil
+	}
+
+	w, err := u.client.GetWebsite(ctx, websiteID)
+	if err != nil {
+		return prommetrics.WebsiteSnapshot{}, err
+	}
+	settings := u.cfg.ForWebsite(w.ID, w.Domain)
+	if window != nil {
+		settings.Windows = []config.Window{*window}
+	}
+
+	ws, ff := u.fetchWebsite(ctx, *w, settings, nil)
+	if ff.any() {
+		return ws, fmt.Errorf("website %s: some requests failed", websiteID)
+	}
+	ws.LastSuccess = time.Now()
+
+	if u.cfg.ProbeTTL > 0 {
+		u.probeMu.Lock()
+		u.probeCache[key] = probeEntry{ws: ws, expires: ws.LastSuccess.Add(u.cfg.ProbeTTL)}
+		u.probeMu.Unlock()
+	}
+	return ws, nil
+}
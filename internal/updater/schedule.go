@@ -0,0 +1,248 @@
+package updater
+
+import (
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/config"
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/umami"
+)
+
+// task is one request of an update cycle: active visitors, a pageview bucket
+// unit, or the stats, a metric type or an event property of a window.
+type task struct {
+	key      string
+	website  string
+	interval time.Duration
+	// high-priority tasks are never deferred by the request budget
+	high bool
+	prio int
+	cost int
+}
+
+// cyclePlan lists the requests allowed during a cycle, i.e. those due
+// according to their refresh interval and fitting in the request budget.
+// A nil plan allows every request.
+type cyclePlan struct {
+	allowed map[string]bool
+}
+
+func (p *cyclePlan) allow(websiteID, window, name string) bool {
+	return p == nil || p.allowed[taskKey(websiteID, window, name)]
+}
+
+func taskKey(websiteID, window, name string) string {
+	return websiteID + "\x00" + window + "\x00" + name
+}
+
+func bucketTask(unit string) string {
+	return "bucket:" + unit
+}
+
+func metricTask(typ string) string {
+	return "metric:" + typ
+}
+
+func eventTask(ep config.EventProperty) string {
+	return "event:" + ep.Event + ":" + ep.Property
+}
+
+// tasks lists the requests of a website in an update cycle.
+func (u *Updater) tasks(w umami.Website, settings config.WebsiteSettings) []task {
+	out := []task{{
+		key:      taskKey(w.ID, "", config.RefreshActive),
+		interval: settings.RefreshInterval(config.RefreshActive),
+		high:     true,
+		cost:     1,
+	}}
+	for _, unit := range u.cfg.BucketUnits {
+		out = append(out, task{
+			key:      taskKey(w.ID, "", bucketTask(unit)),
+			interval: settings.RefreshInterval(config.RefreshBuckets),
+			high:     true,
+			cost:     1,
+		})
+	}
+	for _, win := range settings.Windows {
+		out = append(out, task{
+			key:      taskKey(w.ID, win.Name, config.RefreshStats),
+			interval: settings.RefreshInterval(config.RefreshStats),
+			high:     true,
+			cost:     1,
+		})
+		for i, typ := range settings.MetricTypes {
+			out = append(out, task{
+				key:      taskKey(w.ID, win.Name, metricTask(typ)),
+				interval: settings.RefreshInterval(typ),
+				prio:     i,
+				cost:     1,
+			})
+		}
+		for j, ep := range u.cfg.EventProperties {
+			// wildcards need at least one more request to list properties
+			cost := 1
+			if ep.Event == "*" || ep.Property == "*" {
+				cost = 2
+			}
+			out = append(out, task{
+				key:      taskKey(w.ID, win.Name, eventTask(ep)),
+				interval: settings.RefreshInterval(config.RefreshEventProperties),
+				prio:     len(settings.MetricTypes) + j,
+				cost:     cost,
+			})
+		}
+	}
+	for i := range out {
+		out[i].website = w.ID
+	}
+	return out
+}
+
+// planCycle selects the requests of the cycle starting at now: those due
+// according to the schedule, then among them those fitting in the request
+// budget. Selected requests are scheduled for their next refresh. It returns
+// nil, allowing every request, when neither refresh intervals nor a request
+// budget are configured.
+func (u *Updater) planCycle(websites []umami.Website, now time.Time) *cyclePlan {
+	if u.sched == nil && u.cfg.RequestBudget <= 0 {
+		return nil
+	}
+
+	plan := &cyclePlan{allowed: make(map[string]bool)}
+	var due, low []task
+	high := 0
+	for _, w := range websites {
+		for _, t := range u.tasks(w, u.cfg.ForWebsite(w.ID, w.Domain)) {
+			if u.sched != nil && !u.sched.due(t.website, t.key, now) {
+				continue
+			}
+			due = append(due, t)
+			if t.high {
+				high += t.cost
+				plan.allowed[t.key] = true
+			} else {
+				low = append(low, t)
+			}
+		}
+	}
+
+	if u.cfg.RequestBudget > 0 {
+		u.applyBudget(plan, high, low)
+	} else {
+		for _, t := range low {
+			plan.allowed[t.key] = true
+		}
+	}
+
+	if u.sched != nil {
+		for _, t := range due {
+			if plan.allowed[t.key] {
+				u.sched.fetched(t.website, t.key, t.interval, now)
+			}
+		}
+	}
+	return plan
+}
+
+// schedule holds, per website, when each task is next due. The updater wakes
+// up every tick, so a task is due when its next refresh falls before the middle
+// of the coming tick.
+type schedule struct {
+	tick time.Duration
+	next map[string]map[string]time.Time
+}
+
+func newSchedule(tick time.Duration) *schedule {
+	return &schedule{tick: tick, next: make(map[string]map[string]time.Time)}
+}
+
+// due reports whether the task key of a website must be fetched at now.
+// Tasks never fetched are always due.
+func (s *schedule) due(websiteID, key string, now time.Time) bool {
+	next, ok := s.next[websiteID][key]
+	return !ok || !next.After(now.Add(s.tick/2))
+}
+
+// fetched schedules the next refresh of a task fetched at now. The first
+// refresh is delayed by a random duration between one tick and interval so
+// that tasks sharing an interval are spread over it instead of all running in
+// the same cycle; later ones keep that phase.
+func (s *schedule) fetched(websiteID, key string, interval time.Duration, now time.Time) {
+	m := s.next[websiteID]
+	if m == nil {
+		m = make(map[string]time.Time)
+		s.next[websiteID] = m
+	}
+	next, ok := m[key]
+	if ok {
+		next = next.Add(interval)
+	}
+	if !next.After(now) {
+		next = now.Add(interval)
+		if spread := interval - s.tick; !ok && spread > 0 {
+			next = next.Add(-rand.N(spread))
+		}
+	}
+	m[key] = next
+}
+
+// retry makes failed tasks of a website due again at the next tick.
+func (s *schedule) retry(websiteID string, keys []string, now time.Time) {
+	if s == nil {
+		return
+	}
+	for _, key := range keys {
+		if m := s.next[websiteID]; m != nil {
+			m[key] = now
+		}
+	}
+}
+
+// forget makes every task of a website due, e.g. once its cached values are dropped.
+func (s *schedule) forget(websiteID string) {
+	if s != nil {
+		delete(s.next, websiteID)
+	}
+}
+
+// prune forgets websites not in seen.
+func (s *schedule) prune(seen map[string]struct{}) {
+	if s == nil {
+		return
+	}
+	for id := range s.next {
+		if _, ok := seen[id]; !ok {
+			delete(s.next, id)
+		}
+	}
+}
+
+// failedTasks returns the keys of the tasks of a website that failed.
+func failedTasks(websiteID string, ff fetchFailures) []string {
+	var keys []string
+	if ff.active {
+		keys = append(keys, taskKey(websiteID, "", config.RefreshActive))
+	}
+	for _, unit := range ff.buckets {
+		keys = append(keys, taskKey(websiteID, "", bucketTask(unit)))
+	}
+	for window, wf := range ff.windows {
+		if wf.stats {
+			keys = append(keys, taskKey(websiteID, window, config.RefreshStats))
+		}
+		for _, typ := range wf.types {
+			keys = append(keys, taskKey(websiteID, window, metricTask(typ)))
+		}
+		for _, ep := range wf.events {
+			keys = append(keys, taskKey(websiteID, window, eventTask(ep)))
+		}
+	}
+	return keys
+}
+
+// websiteOfTask returns the website ID of a task key.
+func websiteOfTask(key string) string {
+	id, _, _ := strings.Cut(key, "\x00")
+	return id
+}
@@ -0,0 +1,38 @@
+package updater
+
+import (
+	"context"
+	"time"
+
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/umami"
+)
+
+// Websites returns the enabled websites of the instance. The list is cached
+// for the configured probe TTL.
+func (u *Updater) Websites(ctx context.Context) ([]umami.Website, error) {
+	now := time.Now()
+	u.probeMu.Lock()
+	if now.Before(u.websitesExpire) {
+		websites := u.websites
+		u.probeMu.Unlock()
+		return websites, nil
+	}
+	u.probeMu.Unlock()
+
+	websites, err := u.client.GetWebsites(ctx)
+	if err != nil {
+		return nil, err
+	}
+	enabled := websites[:0]
+	for _, w := range websites {
+		if !u.cfg.ForWebsite(w.ID, w.Domain).Disabled {
+			enabled = append(enabled, w)
+		}
+	}
+
+	u.probeMu.Lock()
+	u.websites = enabled
+	u.websitesExpire = now.Add(u.cfg.ProbeTTL)
+	u.probeMu.Unlock()
+	return enabled, nil
+}
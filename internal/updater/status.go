@@ -0,0 +1,179 @@
+package updater
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Status describes the state of an updater, as served by /status.
+type Status struct {
+	Instance  string `json:"instance"`
+	ProbeOnly bool   `json:"probe_only"`
+	Alive     bool   `json:"alive"`
+	Ready     bool   `json:"ready"`
+	// Circuit is the state of the circuit breaker of the Umami client.
+	Circuit string `json:"circuit"`
+
+	// LastSuccess is true when the last cycle succeeded.
+	LastSuccess bool `json:"last_success"`
+	// LastFetch is the time of the last successful cycle, possibly restored
+	// from the cache file.
+	LastFetch time.Time `json:"last_fetch,omitzero"`
+	// CycleRunning is true while a cycle runs, started at LastCycleStart.
+	CycleRunning          bool            `json:"cycle_running"`
+	LastCycleStart        time.Time       `json:"last_cycle_start,omitzero"`
+	LastCycleDurationSecs float64         `json:"last_cycle_duration_seconds"`
+	LastCycleError        string          `json:"last_cycle_error,omitempty"`
+	Websites              int             `json:"websites"`
+	StaleWebsites         int             `json:"stale_websites"`
+	WebsitesWithErrors    []WebsiteStatus `json:"websites_with_errors"`
+}
+
+// WebsiteStatus describes a website whose last fetch failed.
+type WebsiteStatus struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Domain      string    `json:"domain"`
+	Stale       bool      `json:"stale"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	// Failed lists the failed requests, e.g. "active" or "30d metrics url".
+	Failed []string `json:"failed"`
+	// Error is the error of the last failed request.
+	Error string `json:"error"`
+}
+
+// cycleStatus is the outcome of the last cycle, guarded by Updater.statusMu.
+type cycleStatus struct {
+	// heartbeat is the last time the loop started or finished a cycle.
+	heartbeat time.Time
+	running   bool
+	start     time.Time
+	duration  time.Duration
+	err       error
+	succeeded bool
+
+	websites int
+	stale    int
+	errors   []WebsiteStatus
+}
+
+// beginCycle records the start of a cycle.
+func (u *Updater) beginCycle(now time.Time) {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	u.status.heartbeat = now
+	u.status.running = true
+	u.status.start = now
+}
+
+// endCycle records the end of a cycle, failed with err if not nil.
+func (u *Updater) endCycle(now time.Time, err error) {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	u.status.heartbeat = now
+	u.status.running = false
+	u.status.duration = now.Sub(u.status.start)
+	u.status.err = err
+	if err == nil {
+		u.status.succeeded = true
+	}
+}
+
+// setWebsiteStatus records the websites of the last successful cycle and the
+// failures of their fetches.
+func (u *Updater) setWebsiteStatus(websites, stale int, failed []WebsiteStatus) {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	u.status.websites = websites
+	u.status.stale = stale
+	u.status.errors = failed
+}
+
+// Alive reports whether the update loop is not wedged: it started or finished
+// a cycle within one refresh interval plus the liveness timeout. Updaters
+// without a loop are always alive.
+func (u *Updater) Alive(now time.Time) bool {
+	if u.cfg.ProbeOnly {
+		return true
+	}
+	u.statusMu.Lock()
+	heartbeat := u.status.heartbeat
+	u.statusMu.Unlock()
+	return heartbeat.IsZero() || now.Sub(heartbeat) <= u.interval+u.cfg.LivenessTimeout
+}
+
+// Ready reports whether the updater serves fresh data: a cycle succeeded since
+// startup and the last success is at most ReadyIntervals refresh intervals old,
+// plus the duration of the last cycle. Updaters without a loop are always ready.
+func (u *Updater) Ready(now time.Time) bool {
+	if u.cfg.ProbeOnly {
+		return true
+	}
+	u.statusMu.Lock()
+	succeeded, duration := u.status.succeeded, u.status.duration
+	u.statusMu.Unlock()
+	if !succeeded {
+		return false
+	}
+	last := time.Unix(u.LastFetchUnix(), 0)
+	return now.Sub(last) <= time.Duration(u.cfg.ReadyIntervals)*u.interval+duration
+}
+
+// Status returns the state of the updater at now.
+func (u *Updater) Status(now time.Time) Status {
+	st := Status{
+		Instance:    u.cfg.Name,
+		ProbeOnly:   u.cfg.ProbeOnly,
+		Alive:       u.Alive(now),
+		Ready:       u.Ready(now),
+		Circuit:     u.CircuitState(),
+		LastSuccess: u.LastSuccess(),
+	}
+	if last := atomic.LoadInt64(&u.lastFetchUnix); last > 0 {
+		st.LastFetch = time.Unix(last, 0).UTC()
+	}
+
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	st.CycleRunning = u.status.running
+	st.LastCycleStart = u.status.start
+	st.LastCycleDurationSecs = u.status.duration.Seconds()
+	if u.status.err != nil {
+		st.LastCycleError = u.status.err.Error()
+	}
+	st.Websites = u.status.websites
+	st.StaleWebsites = u.status.stale
+	st.WebsitesWithErrors = append([]WebsiteStatus{}, u.status.errors...)
+	return st
+}
+
+// failedRequests describes the failed requests of ff, e.g. "active" or
+// "30d metrics url".
+func failedRequests(ff fetchFailures) []string {
+	var out []string
+	if ff.active {
+		out = append(out, "active")
+	}
+	for _, unit := range ff.buckets {
+		out = append(out, "bucket "+unit)
+	}
+	windows := make([]string, 0, len(ff.windows))
+	for name := range ff.windows {
+		windows = append(windows, name)
+	}
+	sort.Strings(windows)
+	for _, name := range windows {
+		wf := ff.windows[name]
+		if wf.stats {
+			out = append(out, name+" stats")
+		}
+		for _, typ := range wf.types {
+			out = append(out, name+" metrics "+typ)
+		}
+		for _, ep := range wf.events {
+			out = append(out, name+" event "+ep.Event+":"+ep.Property)
+		}
+	}
+	return out
+}
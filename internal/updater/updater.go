@@ -2,12 +2,14 @@ package updater
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/config"
 	prommetrics "github.com/GuillaumeOuint/umami-prometheus-exporter/internal/metrics"
 	"github.com/GuillaumeOuint/umami-prometheus-exporter/internal/umami"
 )
@@ -16,30 +18,84 @@ import (
 type Updater struct {
 	client      *umami.Client
 	metrics     *prommetrics.Metrics
+	cfg         *config.Instance
 	interval    time.Duration
 	concurrency int
-	metricLimit int
-	metricTypes []string
+	staleWindow time.Duration
 	logger      *log.Logger
 
+	// cache holds the last snapshot published for each website, keyed by website ID.
+	// It is only accessed from fetchAndUpdate, which never runs concurrently.
+	cache map[string]prommetrics.WebsiteSnapshot
+
+	// sched holds when each request is next due, nil when every kind of data
+	// is refreshed at every cycle.
+	sched *schedule
+
+	// listed is the website list fetched by the cycle started at listedAt. It is
+	// reused by cycles run at shorter refresh intervals and only accessed from
+	// fetchAndUpdate.
+	listed   []umami.Website
+	listedAt time.Time
+
+	// cycle numbers update cycles run with a request budget and lowFetched
+	// holds, per low-priority request, the last cycle it was allowed in.
+	cycle      uint64
+	lowFetched map[string]uint64
+
+	// probeMu guards the caches of probes and of the website list served to
+	// service discovery.
+	probeMu        sync.Mutex
+	probeCache     map[string]probeEntry
+	websites       []umami.Website
+	websitesExpire time.Time
+
+	// statusMu guards status, the outcome of the last cycle served by /status.
+	statusMu sync.Mutex
+	status   cycleStatus
+
 	lastSuccess   int32
 	lastFetchUnix int64
 }
 
-// New creates a new Updater instance.
-func New(client *umami.Client, m *prommetrics.Metrics, interval time.Duration, concurrency, metricLimit int, metricTypes []string, logger *log.Logger) *Updater {
+// New creates a new Updater for one Umami instance. Refresh intervals, concurrency,
+// stale window and per-website settings are taken from cfg. Update cycles run
+// at the shortest refresh interval and only fetch the data due at that time.
+func New(client *umami.Client, m *prommetrics.Metrics, cfg *config.Instance, logger *log.Logger) *Updater {
 	if logger == nil {
 		logger = log.Default()
 	}
-	return &Updater{
+	interval := cfg.MinRefreshInterval()
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	u := &Updater{
 		client:      client,
 		metrics:     m,
+		cfg:         cfg,
 		interval:    interval,
-		concurrency: concurrency,
-		metricLimit: metricLimit,
-		metricTypes: metricTypes,
+		concurrency: cfg.Concurrency,
+		staleWindow: cfg.StaleWindow,
 		logger:      logger,
+		cache:       make(map[string]prommetrics.WebsiteSnapshot),
+		lowFetched:  make(map[string]uint64),
+		probeCache:  make(map[string]probeEntry),
 	}
+	if cfg.Scheduled() {
+		u.sched = newSchedule(interval)
+	}
+	return u
+}
+
+// Name returns the name of the Umami instance the updater collects.
+func (u *Updater) Name() string {
+	return u.cfg.Name
+}
+
+// ProbeOnly reports whether websites are only collected through probes, in
+// which case Start must not be called.
+func (u *Updater) ProbeOnly() bool {
+	return u.cfg.ProbeOnly
 }
 
 // LastSuccess returns whether the last update was successful.
@@ -52,42 +108,60 @@ func (u *Updater) LastFetchUnix() int64 {
 	return atomic.LoadInt64(&u.lastFetchUnix)
 }
 
+// CircuitState returns the state of the circuit breaker of the Umami client.
+func (u *Updater) CircuitState() string {
+	return u.client.CircuitState()
+}
+
 // fetchAndUpdate performs a single update cycle.
 func (u *Updater) fetchAndUpdate(ctx context.Context) {
 	u.logger.Println("updater: starting update")
 	start := time.Now()
+	if u.metrics != nil {
+		defer func() {
+			u.metrics.UpdateDuration.WithLabelValues(u.cfg.Name).Observe(time.Since(start).Seconds())
+		}()
+	}
 
-	websites, err := u.client.GetWebsites(ctx)
+	u.beginCycle(start)
+	var cycleErr error
+	defer func() { u.endCycle(time.Now(), cycleErr) }()
+
+	websites, err := u.listWebsites(ctx, start)
 	if err != nil {
 		u.logger.Printf("updater: failed to list websites: %v", err)
 		if u.metrics != nil {
-			u.metrics.FetchSuccess.Set(0)
+			u.metrics.FetchSuccess.WithLabelValues(u.cfg.Name).Set(0)
 		}
 		atomic.StoreInt32(&u.lastSuccess, 0)
+		cycleErr = fmt.Errorf("list websites: %w", err)
+		u.publishCache(time.Now())
 		return
 	}
 
-	// best-effort reset of dynamic metrics to avoid stale label values.
-	if u.metrics != nil {
-		func() {
-			defer func() { _ = recover() }()
-			u.metrics.WebsitePageviews.Reset()
-			u.metrics.WebsiteVisitors.Reset()
-			u.metrics.WebsiteVisits.Reset()
-			u.metrics.WebsiteBounces.Reset()
-			u.metrics.WebsiteTotaltimeSeconds.Reset()
-			u.metrics.WebsiteActiveVisitors.Reset()
-			u.metrics.MetricValues.Reset()
-		}()
+	enabled := make([]umami.Website, 0, len(websites))
+	for _, w := range websites {
+		if !u.cfg.ForWebsite(w.ID, w.Domain).Disabled {
+			enabled = append(enabled, w)
+		}
 	}
+	websites = enabled
+
+	plan := u.planCycle(websites, start)
+
+	// Each website fills its own slot; the snapshot is published only once the
+	// whole cycle is done so scrapes never see a half-filled set of series.
+	snap := &prommetrics.Snapshot{Websites: make([]prommetrics.WebsiteSnapshot, len(websites))}
+	failures := make([]fetchFailures, len(websites))
 
 	var wg sync.WaitGroup
 	sem := make(chan struct{}, u.concurrency)
 
-	for _, w := range websites {
+	for i, w := range websites {
 		select {
 		case <-ctx.Done():
 			u.logger.Println("updater: context canceled, aborting update")
+			cycleErr = ctx.Err()
 			return
 		default:
 		}
@@ -95,71 +169,324 @@ func (u *Updater) fetchAndUpdate(ctx context.Context) {
 		wg.Add(1)
 		sem <- struct{}{}
 
-		go func(w umami.Website) {
+		go func(i int, w umami.Website) {
 			defer wg.Done()
 			defer func() { <-sem }()
-
-			// Fetch summarized stats
-			stats, err := u.client.GetWebsiteStats(ctx, w.ID)
-			if err != nil {
-				u.logger.Printf("updater: website %s stats error: %v", w.ID, err)
-			} else if stats != nil {
-				u.metrics.WebsitePageviews.WithLabelValues(w.ID, w.Name, w.Domain).Set(stats.Pageviews.Value)
-				u.metrics.WebsiteVisitors.WithLabelValues(w.ID, w.Name, w.Domain).Set(stats.Visitors.Value)
-				u.metrics.WebsiteVisits.WithLabelValues(w.ID, w.Name, w.Domain).Set(stats.Visits.Value)
-				u.metrics.WebsiteBounces.WithLabelValues(w.ID, w.Name, w.Domain).Set(stats.Bounces.Value)
-				u.metrics.WebsiteTotaltimeSeconds.WithLabelValues(w.ID, w.Name, w.Domain).Set(stats.Totaltime.Value)
-			}
-
-			// Active visitors
-			if v, err := u.client.GetWebsiteActive(ctx, w.ID); err != nil {
-				u.logger.Printf("updater: website %s active error: %v", w.ID, err)
-			} else {
-				u.metrics.WebsiteActiveVisitors.WithLabelValues(w.ID, w.Name, w.Domain).Set(v)
-			}
-
-			// Metrics by type (url, referrer, browser, ...)
-			for _, typ := range u.metricTypes {
-				entries, err := u.client.GetWebsiteMetrics(ctx, w.ID, typ, u.metricLimit)
-				if err != nil {
-					u.logger.Printf("updater: website %s metrics type %s error: %v", w.ID, typ, err)
-					continue
-				}
-				for _, e := range entries {
-					val := strings.TrimSpace(e.X)
-					if val == "" {
-						val = "<empty>"
-					}
-					u.metrics.MetricValues.WithLabelValues(w.ID, w.Name, w.Domain, typ, val).Set(e.Y)
-				}
-			}
-		}(w)
+			snap.Websites[i], failures[i] = u.fetchWebsite(ctx, w, u.cfg.ForWebsite(w.ID, w.Domain), plan)
+		}(i, w)
 	}
 
 	wg.Wait()
 
-	// update success indicators
+	now := time.Now()
+	var stale int
+	var failed []WebsiteStatus
+	for i := range snap.Websites {
+		ws := &snap.Websites[i]
+		if n := failures[i].count(); n > 0 && u.metrics != nil {
+			u.metrics.WebsiteErrors.WithLabelValues(u.cfg.Name, ws.ID).Add(float64(n))
+		}
+		u.sched.retry(ws.ID, failedTasks(ws.ID, failures[i]), now)
+		u.applyCache(ws, failures[i], now)
+		if ws.Stale {
+			stale++
+		}
+		if failures[i].any() {
+			failed = append(failed, WebsiteStatus{
+				ID: ws.ID, Name: ws.Name, Domain: ws.Domain,
+				Stale: ws.Stale, LastSuccess: ws.LastSuccess,
+				Failed: failedRequests(failures[i]), Error: failures[i].err.Error(),
+			})
+		}
+	}
+	u.setWebsiteStatus(len(snap.Websites), stale, failed)
+	u.pruneCache(snap)
+	u.foldSnapshot(snap)
+
+	// swap in the new snapshot and update success indicators
 	if u.metrics != nil {
-		u.metrics.FetchSuccess.Set(1)
+		u.metrics.Publish(u.cfg.Name, snap)
+		u.metrics.FetchSuccess.WithLabelValues(u.cfg.Name).Set(1)
 	}
 	atomic.StoreInt32(&u.lastSuccess, 1)
-	now := time.Now().Unix()
 	if u.metrics != nil {
-		u.metrics.LastFetch.Set(float64(now))
+		u.metrics.LastFetch.WithLabelValues(u.cfg.Name).Set(float64(now.Unix()))
+	}
+	atomic.StoreInt64(&u.lastFetchUnix, now.Unix())
+	if err := u.saveCache(snap, now); err != nil {
+		u.logger.Printf("updater: failed to save cache: %v", err)
 	}
-	atomic.StoreInt64(&u.lastFetchUnix, now)
 	u.logger.Printf("updater: finished update: websites=%d duration=%s", len(websites), time.Since(start))
 }
 
-// Start runs the updater loop until ctx is canceled.
-func (u *Updater) Start(ctx context.Context) {
-	// Immediate update
+// listWebsites returns the websites of the instance. The list is fetched again
+// once per refresh interval, so that cycles woken up by shorter refresh
+// intervals do not walk every page of websites and teams each time.
+func (u *Updater) listWebsites(ctx context.Context, now time.Time) ([]umami.Website, error) {
+	if u.listed != nil && now.Sub(u.listedAt) < u.cfg.Interval-u.interval/2 {
+		return u.listed, nil
+	}
+	websites, err := u.client.GetWebsites(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u.listed, u.listedAt = websites, now
+	return websites, nil
+}
+
+// foldSnapshot counts the values folded by the top-N limit and applies the
+// series budget to snap.
+func (u *Updater) foldSnapshot(snap *prommetrics.Snapshot) {
+	for _, w := range snap.Websites {
+		for _, win := range w.Windows {
+			snap.FoldedTopN += win.Folded
+		}
+	}
+	snap.FoldedBudget = applySeriesBudget(snap, u.cfg.SeriesBudget)
+	if snap.FoldedBudget > 0 {
+		u.logger.Printf("updater: series budget %d reached, folded %d values into %s", u.cfg.SeriesBudget, snap.FoldedBudget, OtherValue)
+	}
+}
+
+// fetchWebsite collects active visitors, the last complete pageview buckets and,
+// for every configured window, stats and per-type metrics of a single website.
+// Failed requests are logged, leave the corresponding fields empty and are
+// reported in the returned fetchFailures, as are the requests not allowed by
+// plan.
+func (u *Updater) fetchWebsite(ctx context.Context, w umami.Website, settings config.WebsiteSettings, plan *cyclePlan) (prommetrics.WebsiteSnapshot, fetchFailures) {
+	ws := prommetrics.WebsiteSnapshot{ID: w.ID, Name: w.Name, Domain: w.Domain, Labels: settings.Labels}
+	var ff fetchFailures
+
+	// Active visitors
+	if !plan.allow(w.ID, "", config.RefreshActive) {
+		ff.deferredActive = true
+	} else if v, err := u.client.GetWebsiteActive(ctx, w.ID); err != nil {
+		u.logger.Printf("updater: website %s active error: %v", w.ID, err)
+		ff.active = true
+		ff.err = err
+	} else {
+		ws.Active = &v
+	}
+
+	now := time.Now()
+	for _, unit := range u.cfg.BucketUnits {
+		if !plan.allow(w.ID, "", bucketTask(unit)) {
+			ff.deferredBuckets = append(ff.deferredBuckets, unit)
+			continue
+		}
+		start, end := config.LastBucket(unit, now, u.cfg.Location)
+		// the end is exclusive, keep the next bucket out of the range
+		ps, err := u.client.GetWebsitePageviews(ctx, w.ID, start, end.Add(-time.Millisecond), unit, u.cfg.Location.String())
+		if err != nil {
+			u.logger.Printf("updater: website %s pageviews unit %s error: %v", w.ID, unit, err)
+			ff.buckets = append(ff.buckets, unit)
+			ff.err = err
+			continue
+		}
+		b := prommetrics.BucketSnapshot{Unit: unit, Start: start}
+		for _, e := range ps.Pageviews {
+			b.Pageviews += e.Y
+		}
+		for _, e := range ps.Sessions {
+			b.Sessions += e.Y
+		}
+		ws.Buckets = append(ws.Buckets, b)
+	}
+
+	for _, win := range settings.Windows {
+		start, end := win.Range(now, u.cfg.Location)
+		snap, wf := u.fetchWindow(ctx, w, win.Name, start, end, settings, plan)
+		ws.Windows = append(ws.Windows, snap)
+		if wf.any() || wf.deferred() {
+			if ff.windows == nil {
+				ff.windows = make(map[string]windowFailures)
+			}
+			ff.windows[win.Name] = wf
+			if wf.err != nil {
+				ff.err = wf.err
+			}
+		}
+	}
+
+	return ws, ff
+}
+
+// fetchWindow collects stats and per-type metrics of a website between start and end.
+// Requests not allowed by plan are skipped.
+func (u *Updater) fetchWindow(ctx context.Context, w umami.Website, window string, start, end time.Time, settings config.WebsiteSettings, plan *cyclePlan) (prommetrics.WindowSnapshot, windowFailures) {
+	ws := prommetrics.WindowSnapshot{Name: window}
+	var wf windowFailures
+
+	// Fetch summarized stats
+	var stats *umami.WebsiteStats
+	var err error
+	if !plan.allow(w.ID, window, config.RefreshStats) {
+		wf.deferredStats = true
+	} else if stats, err = u.client.GetWebsiteStats(ctx, w.ID, start, end); err != nil {
+		u.logger.Printf("updater: website %s window %s stats error: %v", w.ID, window, err)
+		wf.stats = true
+		wf.err = err
+	} else if stats != nil {
+		ws.Stats = &prommetrics.Stats{
+			Pageviews: prommetrics.StatValue(stats.Pageviews),
+			Visitors:  prommetrics.StatValue(stats.Visitors),
+			Visits:    prommetrics.StatValue(stats.Visits),
+			Bounces:   prommetrics.StatValue(stats.Bounces),
+			Totaltime: prommetrics.StatValue(stats.Totaltime),
+		}
+		ws.Engagement = engagement(ws.Stats)
+	}
+
+	// Metrics by type (url, referrer, browser, ...)
+	for _, typ := range settings.MetricTypes {
+		if !plan.allow(w.ID, window, metricTask(typ)) {
+			wf.deferredTypes = append(wf.deferredTypes, typ)
+			continue
+		}
+		entries, err := u.client.GetWebsiteMetrics(ctx, w.ID, typ, start, end, settings.MetricLimit)
+		if err != nil {
+			u.logger.Printf("updater: website %s window %s metrics type %s error: %v", w.ID, window, typ, err)
+			wf.types = append(wf.types, typ)
+			wf.err = err
+			continue
+		}
+		if typ != "referrer" || u.cfg.ReferrerGrouper.KeepRaw() {
+			ws.Metrics = append(ws.Metrics, aggregate(typ, entries, func(x string) string {
+				return u.normalizeValue(typ, strings.TrimSpace(x))
+			})...)
+		}
+		if typ == "referrer" && u.cfg.ReferrerGrouper != nil {
+			ws.Metrics = append(ws.Metrics, aggregate(ReferrerDomainType, entries, u.cfg.ReferrerGrouper.Domain)...)
+		}
+	}
+	ws.Metrics, ws.Folded = foldTopN(ws.Metrics, settings.MetricTopN, metricValueKind)
+
+	// Custom event properties; overlapping selectors fetch each pair once
+	fetched := make(map[config.EventProperty]bool)
+	for _, ep := range u.cfg.EventProperties {
+		if !plan.allow(w.ID, window, eventTask(ep)) {
+			wf.deferredEvents = append(wf.deferredEvents, ep)
+			continue
+		}
+		values, err := u.fetchEventProperty(ctx, w.ID, ep, start, end, fetched)
+		if err != nil {
+			u.logger.Printf("updater: website %s window %s event %s property %s error: %v", w.ID, window, ep.Event, ep.Property, err)
+			wf.events = append(wf.events, ep)
+			wf.err = err
+			continue
+		}
+		ws.EventProperties = append(ws.EventProperties, values...)
+	}
+	var folded int
+	ws.EventProperties, folded = foldTopN(ws.EventProperties, settings.MetricTopN, eventPropertyKind)
+	ws.Folded += folded
+
+	return ws, wf
+}
+
+// fetchEventProperty collects the values of the event properties selected by ep,
+// skipping pairs already in fetched. Wildcards are resolved against the events
+// and properties recorded in the window.
+func (u *Updater) fetchEventProperty(ctx context.Context, id string, ep config.EventProperty, start, end time.Time, fetched map[config.EventProperty]bool) ([]prommetrics.EventPropertyValue, error) {
+	pairs := []config.EventProperty{ep}
+	if ep.Event == "*" || ep.Property == "*" {
+		event := ep.Event
+		if event == "*" {
+			event = ""
+		}
+		keys, err := u.client.GetEventDataEvents(ctx, id, event, start, end)
+		if err != nil {
+			return nil, err
+		}
+		pairs = pairs[:0]
+		for _, k := range keys {
+			if ep.Property == "*" || k.PropertyName == ep.Property {
+				pairs = append(pairs, config.EventProperty{Event: k.EventName, Property: k.PropertyName})
+			}
+		}
+	}
+
+	var out []prommetrics.EventPropertyValue
+	for _, p := range pairs {
+		if fetched[p] {
+			continue
+		}
+		fetched[p] = true
+		values, err := u.client.GetEventDataValues(ctx, id, p.Event, p.Property, start, end)
+		if err != nil {
+			return nil, err
+		}
+		index := make(map[string]int, len(values))
+		offset := len(out)
+		for _, v := range values {
+			val := ""
+			if v.Value != nil {
+				val = strings.TrimSpace(fmt.Sprint(v.Value))
+			}
+			if val == "" {
+				val = "<empty>"
+			}
+			if j, ok := index[val]; ok {
+				out[offset+j].Count += v.Total
+				continue
+			}
+			index[val] = len(out) - offset
+			out = append(out, prommetrics.EventPropertyValue{Event: p.Event, Property: p.Property, Value: val, Count: v.Total})
+		}
+	}
+	return out, nil
+}
+
+// aggregate converts entries into metric values of type typ. Each entry is
+// mapped through label and entries that map to the same value are summed.
+func aggregate(typ string, entries []umami.MetricEntry, label func(string) string) []prommetrics.MetricValue {
+	out := make([]prommetrics.MetricValue, 0, len(entries))
+	index := make(map[string]int, len(entries))
+	for _, e := range entries {
+		val := label(e.X)
+		if val == "" {
+			val = "<empty>"
+		}
+		if j, ok := index[val]; ok {
+			out[j].Count += e.Y
+			continue
+		}
+		index[val] = len(out)
+		out = append(out, prommetrics.MetricValue{Type: typ, Value: val, Count: e.Y})
+	}
+	return out
+}
+
+// normalizeValue rewrites a raw metric value according to the rules configured
+// for its type.
+func (u *Updater) normalizeValue(typ, val string) string {
+	switch typ {
+	case "url":
+		return u.cfg.URLNormalizer.Normalize(val)
+	}
+	return val
+}
+
+// RunOnce performs a single update cycle and reports whether it succeeded:
+// websites were listed and no request for any website failed.
+func (u *Updater) RunOnce(ctx context.Context) bool {
 	u.fetchAndUpdate(ctx)
+	u.statusMu.Lock()
+	failed := len(u.status.errors)
+	u.statusMu.Unlock()
+	return u.LastSuccess() && failed == 0
+}
 
-	if u.interval <= 0 {
-		u.interval = time.Minute
+// Start runs the updater loop until ctx is canceled, serving the values
+// restored from the cache file until the first update completes.
+func (u *Updater) Start(ctx context.Context) {
+	if err := u.Restore(); err != nil {
+		u.logger.Printf("updater: failed to restore cache: %v", err)
 	}
 
+	// Immediate update
+	u.fetchAndUpdate(ctx)
+
 	ticker := time.NewTicker(u.interval)
 	defer ticker.Stop()
 